@@ -115,6 +115,16 @@ func (r BasicLogRecord) Size() uint32 {
     return r.size
 }
 
+// StoredSize returns the length of the record's data.
+func (r BasicLogRecord) StoredSize() uint32 {
+    return r.size
+}
+
+// Key returns nil, basic records do not have keys.
+func (r BasicLogRecord) Key() []byte {
+    return nil
+}
+
 // IsExpired determines if the record is expired.
 func (r BasicLogRecord) IsExpired(now, ttl int64) bool {
     if ttl <= 0 {
@@ -0,0 +1,36 @@
+package common
+
+// ## **Compaction**
+
+// LatestKeys reads every keyed record of a log and returns the record index
+// of the newest record with each key. Expired records are included.
+func LatestKeys(log WriteAheadLog) (map[string]uint64, error) {
+    cursor, err := log.Cursor(WithExpired(), WithFlags(KeyedFlag, KeyedFlag))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close()
+
+    latest := make(map[string]uint64)
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        latest[string(record.Key())] = cursor.Position() - 1
+    }
+    if err != ErrEndOfLog {
+        return nil, err
+    }
+    return latest, nil
+}
+
+// NewestKey returns a function for `KeyCompactor.CompactKeys` which reports
+// whether a record is the newest record with its key according to the
+// record indexes returned by LatestKeys. Keys which are not in the map and
+// records after the newest known record, which were appended after the map
+// was built, are reported as newest. The base is added to the record index of
+// each record before it is compared.
+func NewestKey(latest map[string]uint64, base uint64) func(key []byte, index uint64) bool {
+    return func(key []byte, index uint64) bool {
+        newest, ok := latest[string(key)]
+        return !ok || base+index >= newest
+    }
+}
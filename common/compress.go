@@ -0,0 +1,111 @@
+package common
+
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "io"
+    "io/ioutil"
+)
+
+// ## **Compression**
+
+// Compressor compresses record data before it is written to the log and
+// decompresses it when it is read. The same compressor must be used to read
+// the log as was used to write it.
+type Compressor interface {
+
+    // Compress returns the compressed form of the data.
+    Compress(data []byte) ([]byte, error)
+
+    // Decompress returns the original data from its compressed form.
+    // `ErrDecompressedSize` is returned if the original data is larger than
+    // `limit` bytes.
+    Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// readLimited reads the decompressed data from the reader.
+// `ErrDecompressedSize` is returned if there are more than `limit` bytes.
+func readLimited(reader io.Reader, limit int) ([]byte, error) {
+    data, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+    if err != nil {
+        return nil, err
+    } else if len(data) > limit {
+        return nil, ErrDecompressedSize
+    }
+    return data, nil
+}
+
+// NewFlateCompressor creates a compressor using DEFLATE at the given
+// `compress/flate` compression level.
+func NewFlateCompressor(level int) Compressor {
+    return flateCompressor{level}
+}
+
+// flateCompressor compresses records with DEFLATE.
+type flateCompressor struct {
+    level int
+}
+
+// Compress compresses the data with DEFLATE.
+func (f flateCompressor) Compress(data []byte) ([]byte, error) {
+    var buffer bytes.Buffer
+    writer, err := flate.NewWriter(&buffer, f.level)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := writer.Write(data); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+// Decompress decompresses DEFLATE data.
+func (f flateCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+    reader := flate.NewReader(bytes.NewReader(data))
+    defer reader.Close()
+    return readLimited(reader, limit)
+}
+
+// NewGzipCompressor creates a compressor using gzip at the given
+// `compress/gzip` compression level. Gzip adds a header and a checksum to
+// each record, which makes it larger than DEFLATE for small records.
+func NewGzipCompressor(level int) Compressor {
+    return gzipCompressor{level}
+}
+
+// gzipCompressor compresses records with gzip.
+type gzipCompressor struct {
+    level int
+}
+
+// Compress compresses the data with gzip.
+func (g gzipCompressor) Compress(data []byte) ([]byte, error) {
+    var buffer bytes.Buffer
+    writer, err := gzip.NewWriterLevel(&buffer, g.level)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := writer.Write(data); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+// Decompress decompresses gzip data.
+func (g gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+    reader, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+    return readLimited(reader, limit)
+}
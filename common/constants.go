@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // ## **Log Variables**
 var (
 
@@ -8,6 +10,9 @@ var (
 
     // IndexFileSignature represents the first 3 bytes of an index file - `IDX`
     IndexFileSignature = []byte("IDX")
+
+    // SnapshotFileSignature is the first 3 bytes of a snapshot file - `SNP`
+    SnapshotFileSignature = []byte("SNP")
 )
 
 // ## **Log Constants**
@@ -22,14 +27,61 @@ const (
     // - `DefaultMaxRecordSize` is the default maximum size of a log record.
     DefaultMaxRecordSize = 0xffff
 
+    // - `DefaultTombstoneRetention` is how long compaction keeps the newest
+    // tombstone of a key.
+    DefaultTombstoneRetention = 24 * time.Hour
+
     // - `LogHeaderSize` is the size of the file header.
-    LogHeaderSize = 8
+    LogHeaderSize = 16
 
     // - `MaximumIndexSlice` is the maximum number of index records to be read at
     // one time
     MaximumIndexSlice = 32000
 )
 
+// ## **Record Flags**
+
+// The high bits of the record flags are reserved for the log in files whose
+// header version has the `ReservedFlagsFeature` bit set. Records with reserved
+// flags cannot be appended to those files. In older files every bit is a user
+// flag.
+const (
+
+    // - `ReservedFlagsFeature` is set in the version byte of the headers of
+    // log and index files created with the reserved record flags. The rest of
+    // the version byte is the file version.
+    ReservedFlagsFeature uint8 = 0x80
+
+    // - `BatchFlag` marks a record which is followed by more records of the
+    // same batch. The last record of a batch does not have the flag, so a
+    // batch is complete once a record without the flag is found.
+    BatchFlag uint32 = 1 << 31
+
+    // - `BaseIndexFlag` is set in the header of log and index files which do
+    // not start at record index 0. The header is followed by the 8-byte
+    // record index of the first record in the file.
+    BaseIndexFlag uint32 = 1 << 30
+
+    // - `CompressionFlag` marks a record whose data was compressed by the
+    // log's `Compressor`.
+    CompressionFlag uint32 = 1 << 29
+
+    // - `EncryptionFlag` marks a record whose data was encrypted with a key
+    // from the log's `KeyProvider`.
+    EncryptionFlag uint32 = 1 << 28
+
+    // - `KeyedFlag` marks a record whose data starts with a record key.
+    KeyedFlag uint32 = 1 << 27
+
+    // - `CompactedFlag` marks an empty record left in place of a record
+    // removed by compaction, so the following records keep their record
+    // indexes. Cursors skip these records.
+    CompactedFlag uint32 = 1 << 26
+
+    // - `ReservedFlags` are the record flags used by the log itself.
+    ReservedFlags = BatchFlag | BaseIndexFlag | CompressionFlag | EncryptionFlag | KeyedFlag | CompactedFlag
+)
+
 // ## **Log State**
 
 // State is used to maintain the current status of the log.
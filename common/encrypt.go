@@ -0,0 +1,147 @@
+package common
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "io"
+
+    "github.com/blacklabeldata/xbinary"
+)
+
+// ## **Encryption**
+
+const (
+
+    // keyIDSize is the size of the key ID stored before the nonce in
+    // encrypted record data
+    keyIDSize = 4
+
+    // nonceSize is the size of the AES-GCM nonce
+    nonceSize = 12
+
+    // tagSize is the size of the AES-GCM authentication tag
+    tagSize = 16
+
+    // EncryptionOverhead is the number of bytes encryption adds to the data
+    // of each record.
+    EncryptionOverhead = keyIDSize + nonceSize + tagSize
+
+    // EncryptedHeaderSize is the size of the record header authenticated
+    // with each encrypted record. Every record format starts with the size,
+    // the flags and the timestamp.
+    EncryptedHeaderSize = 16
+)
+
+// KeyProvider supplies the AES keys used to encrypt records. Keys are 16, 24
+// or 32 bytes long for AES-128, AES-192 or AES-256. Each key has an ID which
+// is stored in the records it encrypts, so the current key can be rotated
+// while older records remain readable with their own key.
+type KeyProvider interface {
+
+    // CurrentKey returns the key used to encrypt new records and its ID.
+    CurrentKey() (uint32, []byte, error)
+
+    // Key returns the key with the given ID. `ErrEncryptionKeyNotFound` is
+    // returned if the provider does not have the key.
+    Key(id uint32) ([]byte, error)
+}
+
+// NewKeyRing creates a key provider from a fixed set of keys. New records are
+// encrypted with the key with the `current` ID.
+func NewKeyRing(current uint32, keys map[uint32][]byte) KeyProvider {
+    ring := keyRing{current, make(map[uint32][]byte, len(keys))}
+    for id, key := range keys {
+        ring.keys[id] = key
+    }
+    return ring
+}
+
+// keyRing is a key provider backed by a map.
+type keyRing struct {
+    current uint32
+    keys    map[uint32][]byte
+}
+
+// CurrentKey returns the current key and its ID.
+func (r keyRing) CurrentKey() (uint32, []byte, error) {
+    key, err := r.Key(r.current)
+    return r.current, key, err
+}
+
+// Key returns the key with the given ID.
+func (r keyRing) Key(id uint32) ([]byte, error) {
+    key, ok := r.keys[id]
+    if !ok {
+        return nil, ErrEncryptionKeyNotFound
+    }
+    return key, nil
+}
+
+// EncryptRecord seals record data with AES-GCM using the provider's current
+// key. The record header is authenticated as associated data, so it must be
+// the header the encrypted data is written with, including the encrypted
+// size. The result is laid out as:
+//
+// ```
+// 4-byte key id
+// 12-byte nonce
+// ciphertext
+// 16-byte tag
+// ```
+func EncryptRecord(provider KeyProvider, header, data []byte) ([]byte, error) {
+    id, key, err := provider.CurrentKey()
+    if err != nil {
+        return nil, err
+    }
+
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+
+    // random nonces are safe for about 2^32 records per key
+    buffer := make([]byte, keyIDSize+nonceSize, EncryptionOverhead+len(data))
+    xbinary.LittleEndian.PutUint32(buffer, 0, id)
+    nonce := buffer[keyIDSize:]
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+    return aead.Seal(buffer, nonce, data, header), nil
+}
+
+// DecryptRecord opens record data sealed by EncryptRecord with the key it was
+// encrypted with. `ErrEncryptionKeyNotFound` is returned if the key is missing
+// and `ErrDecryptionFailed` if the data or the header has been changed.
+func DecryptRecord(provider KeyProvider, header, data []byte) ([]byte, error) {
+    if len(data) < EncryptionOverhead {
+        return nil, ErrDecryptionFailed
+    }
+
+    id, _ := xbinary.LittleEndian.Uint32(data, 0)
+    key, err := provider.Key(id)
+    if err != nil {
+        return nil, err
+    }
+
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := data[keyIDSize : keyIDSize+nonceSize]
+    plaintext, err := aead.Open(nil, nonce, data[keyIDSize+nonceSize:], header)
+    if err != nil {
+        return nil, ErrDecryptionFailed
+    }
+    return plaintext, nil
+}
+
+// newAEAD creates an AES-GCM cipher for the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
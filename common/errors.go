@@ -1,6 +1,9 @@
 package common
 
-import "errors"
+import (
+    "errors"
+    "fmt"
+)
 
 // ## **Possible Log Errors**
 
@@ -48,11 +51,58 @@ var (
     // ErrReadIndexRecord occurs when a record fails to be read from the index
     ErrReadIndexRecord = errors.New("failed to read index record")
 
+    // ErrRecordIndexMismatch occurs when a record read from the data file is
+    // not the record the index file points to
+    ErrRecordIndexMismatch = errors.New("record index does not match index")
+
+    // ErrSegmentGap occurs when the record indexes of two consecutive
+    // segments are not continuous
+    ErrSegmentGap = errors.New("missing records between segments")
+
+    // ErrEndOfLog occurs when a cursor moves past the last record in the log
+    ErrEndOfLog = errors.New("end of log")
+
+    // ErrCompressorRequired occurs when a cursor reads a compressed record
+    // without a compressor.
+    ErrCompressorRequired = errors.New("compressed record requires a compressor")
+
+    // ErrDecompressedSize occurs when compressed record data decompresses to
+    // more than the max record size.
+    ErrDecompressedSize = errors.New("decompressed record is too large")
+
+    // ErrEncryptionKeyNotFound occurs when the key a record was encrypted
+    // with is not available from the key provider.
+    ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+
+    // ErrDecryptionFailed occurs when an encrypted record or its header does
+    // not match the authentication tag.
+    ErrDecryptionFailed = errors.New("record failed decryption")
+
+    // ErrKeyProviderRequired occurs when a cursor reads an encrypted record
+    // without a key provider.
+    ErrKeyProviderRequired = errors.New("encrypted record requires a key provider")
+
+    // ErrStartOfLog occurs when a cursor moves back past the first record in
+    // the log
+    ErrStartOfLog = errors.New("start of log")
+
+    // ErrEndOfRange occurs when a cursor reaches a record written after the
+    // end of its time range
+    ErrEndOfRange = errors.New("end of time range")
+
+    // ErrRecoveryRequired occurs when writing to a log whose data file and
+    // index file do not agree. `Recover` must be called first.
+    ErrRecoveryRequired = errors.New("log is inconsistent; recovery required")
+
     // - `ErrLogAlreadyOpen` occurs when an open log tries to be opened again
     ErrLogAlreadyOpen = errors.New("log already open")
 
-    // - `ErrLogClosed` occurs when `Append` is called after the log has been
-    // closed.
+    // - `ErrIndexOutOfRange` occurs when a record index given to the log is
+    // before the first record or after the last record.
+    ErrIndexOutOfRange = errors.New("record index out of range")
+
+    // - `ErrLogClosed` occurs when the log is written to or read from after
+    // it has been closed.
     ErrLogClosed = errors.New("log has been closed")
 
     // `ErrRecordTooLarge` occurs when writing a record which exceed the max
@@ -75,6 +125,68 @@ var (
     // ErrInvalidLogStrategy occurs when the `config.Strategy` is nil
     ErrInvalidLogStrategy = errors.New("invalid write strategy")
 
+    // ErrInvalidMaxRecordSize occurs when `config.MaxRecordSize` is not
+    // positive.
+    ErrInvalidMaxRecordSize = errors.New("invalid max record size")
+
     // ErrRecordFactorySize
     ErrRecordFactorySize = errors.New("invalid record factory; max record size exceeded")
+
+    // ErrKeyNotFound occurs when a key is not in the stable store or when no
+    // record in a log has the key.
+    ErrKeyNotFound = errors.New("key not found")
+
+    // ErrInvalidRecordKey occurs when the key of a keyed record cannot be
+    // decoded.
+    ErrInvalidRecordKey = errors.New("invalid record key")
+
+    // ErrReservedFlags occurs when record flags given to a log use the bits
+    // reserved by the log.
+    ErrReservedFlags = errors.New("record flags use bits reserved by the log")
+
+    // ErrReservedFlagsUnsupported occurs when a feature which needs the
+    // reserved record flags is used with a file created before they were
+    // reserved.
+    ErrReservedFlagsUnsupported = errors.New("log file does not support reserved record flags")
+
+    // ErrNoSnapshot occurs when a snapshot store does not contain the
+    // requested snapshot.
+    ErrNoSnapshot = errors.New("snapshot not found")
+
+    // ErrSnapshotMismatch occurs when a log does not contain the records a
+    // snapshot was taken of.
+    ErrSnapshotMismatch = errors.New("log does not match snapshot")
+
+    // ErrSnapshotUnsupported occurs when a log cannot compute the hash of an
+    // earlier snapshot.
+    ErrSnapshotUnsupported = errors.New("log does not support snapshot verification")
+
+    // ErrCompactionUnsupported occurs when a log cannot be compacted by key.
+    ErrCompactionUnsupported = errors.New("log does not support compaction")
+
+    // ErrSyncUnsupported occurs when a log cannot be synced on demand.
+    ErrSyncUnsupported = errors.New("log does not support sync")
+
+    // ErrCorruptSnapshot occurs when a snapshot file does not match the
+    // checksum stored in it.
+    ErrCorruptSnapshot = errors.New("corrupt snapshot file")
 )
+
+// CorruptRecordError occurs when a record does not match the checksum stored
+// in its header.
+type CorruptRecordError struct {
+
+    // Index is the record index stored in the record header
+    Index uint64
+
+    // Expected is the checksum stored in the record header
+    Expected uint32
+
+    // Actual is the checksum computed from the record
+    Actual uint32
+}
+
+// Error describes which record is corrupt.
+func (e *CorruptRecordError) Error() string {
+    return fmt.Sprintf("corrupt record %d: checksum %08x does not match %08x", e.Index, e.Actual, e.Expected)
+}
@@ -1,8 +1,10 @@
 package common
 
 import (
+    "context"
     "io"
     "os"
+    "time"
 
     "github.com/blacklabeldata/m3"
 )
@@ -12,52 +14,247 @@ import (
 type WriteAheadLog interface {
     io.WriteCloser
 
+    // ###### *Append*
+
+    // Append appends a record with the log's default flags and returns the
+    // record index assigned to it.
+    Append(data []byte) (uint64, error)
+
+    // AppendWithFlags appends a record with the given flags and returns the
+    // record index assigned to it. Flags reserved by the log are rejected
+    // with `ErrReservedFlags`.
+    AppendWithFlags(flags uint32, data []byte) (uint64, error)
+
+    // ###### *AppendKeyed*
+
+    // AppendKeyed appends a record with a key and returns its record index.
+    // The newest record with a key can be read with GetLatest.
+    AppendKeyed(key, data []byte) (uint64, error)
+
+    // ###### *GetLatest*
+
+    // GetLatest returns the newest record with the given key without
+    // scanning the log. `ErrKeyNotFound` is returned if no record has the
+    // key.
+    GetLatest(key []byte) (LogRecord, error)
+
+    // ###### *Compact*
+
+    // Compact removes keyed records which are not the newest record with
+    // their key, and the newest tombstones once they are older than the
+    // tombstone retention. The remaining records keep their record indexes
+    // and timestamps.
+    Compact() error
+
+    // ###### *WriteBatch*
+
+    // WriteBatch appends several records as one atomic operation. The
+    // records get consecutive record indexes and after a crash recovery
+    // keeps either all of them or none of them. The number of bytes written
+    // is returned.
+    WriteBatch(records [][]byte) (int, error)
+
     // Recover should be called when the log is opened to verify consistency
-    // of the log.
-    Recover() error
+    // of the log. Incomplete records at the end of the log are removed and
+    // missing index records are rebuilt from the data file. The returned
+    // report describes what was repaired.
+    Recover() (RecoveryReport, error)
+
+    // ###### *TruncateAfter*
+
+    // TruncateAfter removes every record after the given record index from
+    // the log. The removed record indexes are reused by later appends.
+    TruncateAfter(index uint64) error
+
+    // ###### *TruncateBefore*
+
+    // TruncateBefore removes records before the given record index from the
+    // log. The remaining records keep their record indexes.
+    TruncateBefore(index uint64) error
 
     // ###### *Cursor*
 
-    // Creates a new Cursor initialized at index 0
-    Cursor() (LogCursor, error)
+    // Creates a new Cursor initialized at index 0, or at the index given with
+    // the `StartAt` option. Records which have expired according to the log's
+    // TTL are skipped unless the `WithExpired` option is given.
+    Cursor(options ...CursorOption) (LogCursor, error)
+
+    // ###### *Range*
+
+    // Range creates a new Cursor initialized at the first record written at
+    // or after `from`. The cursor returns `ErrEndOfRange` when it reaches a
+    // record written at or after `to`, and Prev returns `ErrStartOfLog` when
+    // it reaches a record written before `from`.
+    Range(from, to time.Time, options ...CursorOption) (LogCursor, error)
 
     // ###### *Pipe*
 
     // Pipe copies the raw byte stream into the given `io.Writer` starting at a
     // record offset and reading up until the given limit.
-    // Pipe(offset, limit uint64, writer io.Writer) error
+    Pipe(offset, limit uint64, writer io.Writer) error
+
+    // ###### *Ingest*
+
+    // Ingest appends the records in a raw byte stream created by Pipe. Each
+    // record is validated before it is appended. The number of records
+    // appended is returned.
+    Ingest(reader io.Reader) (uint64, error)
 
     // ###### *Snapshot*
 
     // Snapshot records the current position of the log file.
     Snapshot() (Snapshot, error)
 
+    // ###### *Verify*
+
+    // Verify recomputes the hash of the records covered by a snapshot taken
+    // earlier and returns `ErrSnapshotMismatch` if the log no longer matches
+    // it.
+    Verify(snapshot Snapshot) error
+
     // ###### *Metadata*
 
     // Metadata returns metadata of the log file.
     Metadata() (Metadata, error)
+
+    // ###### *State*
+
+    // State returns whether the log is open or closed. Once a log is closed,
+    // writing to it or creating cursors returns `ErrLogClosed`.
+    State() State
+}
+
+// SnapshotHasher is implemented by logs which can compute the hash a
+// snapshot would have had at an earlier size.
+type SnapshotHasher interface {
+
+    // SnapshotHash returns the snapshot hash of the records before the given
+    // record index.
+    SnapshotHash(size uint64) (uint64, error)
+}
+
+// KeyCompactor is implemented by logs which can be compacted against the
+// newest records of keys stored outside of the log, such as in a newer
+// segment.
+type KeyCompactor interface {
+
+    // CompactKeys removes the keyed records for which `newest` returns false.
+    // It is called with the key and the record index of each keyed record.
+    CompactKeys(newest func(key []byte, index uint64) bool) error
+}
+
+// Reclaimer is implemented by logs which can remove expired records from the
+// start of the log to bound disk usage by the TTL window.
+type Reclaimer interface {
+
+    // Reclaim removes the oldest records once they have expired according to
+    // the log's TTL. Single file logs return the number of records removed
+    // and segmented logs the number of segments removed.
+    Reclaim() (int, error)
+}
+
+// Syncer is implemented by logs which can flush the records written to them
+// to permanent storage whatever their write strategy is.
+type Syncer interface {
+
+    // Sync flushes the data and index files to permanent storage.
+    Sync() error
 }
 
 // LogCursor allows for quite navigation through the log. All Cursor start at zero
-//  and moves forward until EOF.
+//  and moves forward until the end of the log, at which point `ErrEndOfLog`
+// is returned.
 type LogCursor interface {
 
     // ###### *Seek*
 
-    // Seek moves the Cursor to the given record index.
+    // Seek moves the Cursor to the given record index and returns the record.
+    // The following call to Next returns the record after it.
     Seek(offset uint64) (LogRecord, error)
 
+    // ###### *SeekTime*
+
+    // SeekTime moves the Cursor to the first record written at or after the
+    // given time and returns the record. The index is binary searched, which
+    // assumes record timestamps do not decrease.
+    SeekTime(t time.Time) (LogRecord, error)
+
     // ###### *Next*
 
-    // Next moves the Cursor forward one record.
+    // Next moves the Cursor forward one record. `ErrEndOfLog` is returned if
+    // no record has been written at the cursor position yet.
     Next() (LogRecord, error)
 
+    // ###### *Prev*
+
+    // Prev moves the Cursor back one record and returns the record before
+    // the cursor position, so the following call to Next returns the same
+    // record. `ErrStartOfLog` is returned if there is no record before the
+    // cursor position.
+    Prev() (LogRecord, error)
+
+    // ###### *NextWait*
+
+    // NextWait moves the Cursor forward one record like Next, but blocks
+    // until the record is written if it has not been written yet. The wait
+    // ends early with the context's error if the context is cancelled.
+    NextWait(ctx context.Context) (LogRecord, error)
+
+    // ###### *Position*
+
+    // Position returns the index of the record read by the next call to
+    // Next.
+    Position() uint64
+
     // ###### *Close*
 
     // Close cursor and any associates file handles
     Close() error
 }
 
+// CursorOptions describes which records a cursor returns.
+type CursorOptions struct {
+
+    // IncludeExpired returns records which have expired according to the
+    // log's TTL.
+    IncludeExpired bool
+
+    // Start is the record index read by the first call to Next.
+    Start uint64
+
+    // FromEnd starts the cursor after the last record, so the first call to
+    // Prev returns the last record. It overrides Start.
+    FromEnd bool
+
+    // FlagMask and FlagValue only include records whose flags masked with
+    // FlagMask equal FlagValue. A zero mask includes every record.
+    FlagMask  uint32
+    FlagValue uint32
+
+    // Filter only includes records for which it returns true.
+    Filter func(LogRecord) bool
+
+    // Compressor decompresses compressed records. Cursors created by a log
+    // use the log's compressor unless another one is given.
+    Compressor Compressor
+
+    // KeyProvider decrypts encrypted records. Like the compressor, cursors
+    // created by a log use the log's key provider unless another one is
+    // given.
+    KeyProvider KeyProvider
+
+    // Since starts the cursor's time range. Prev stops at the first record
+    // written before it. The zero time does not limit the cursor.
+    Since time.Time
+
+    // Until ends the cursor at the first record written at or after it. The
+    // zero time does not end the cursor.
+    Until time.Time
+}
+
+// CursorOption modifies the options of a new cursor.
+type CursorOption func(*CursorOptions)
+
 // LogRecord describes a single item in the log file. It consists of a time, an
 // index id, a length and the data.
 type LogRecord interface {
@@ -65,6 +262,13 @@ type LogRecord interface {
     // Size returns the size of the record data
     Size() uint32
 
+    // StoredSize returns the size of the record data in the log file, which
+    // is smaller than Size for compressed records
+    StoredSize() uint32
+
+    // Key returns the record key, or nil if the record does not have a key
+    Key() []byte
+
     // Flags returns any boolean flags associated
     Flags() uint32
 
@@ -84,7 +288,22 @@ type LogIndex interface {
 
     Size() uint64
     Header() FileHeader
-    // Slice(offset uint64, limit uint64) (IndexSlice, error)
+
+    // Base returns the record index of the first record in the index.
+    Base() uint64
+
+    // Get returns the index record for the given record index.
+    Get(index uint64) (IndexRecord, error)
+
+    // Slice returns up to `limit` index records starting at `offset`.
+    Slice(offset uint64, limit uint64) (IndexSlice, error)
+
+    // Truncate removes all index records at or after the given record index.
+    Truncate(size uint64) error
+
+    // Sync flushes the index to permanent storage.
+    Sync() error
+
 }
 
 // FileHeader describes which version the file was written with. Flags
@@ -127,11 +346,37 @@ type LogRecordDecoder func() (LogRecord, error)
 // Metadata simply contains descriptive information about the log
 type Metadata struct {
     Size             int64
+    Records          uint64
     LastModifiedTime int64
     FileName         string
     IndexFileName    string
 }
 
+// RecoveryReport describes the repairs made to a log by `Recover`.
+type RecoveryReport struct {
+
+    // RecordsDropped is the number of index records removed because they did
+    // not point to a complete record in the data file.
+    RecordsDropped uint64
+
+    // DataRecordsDropped is the number of records removed from the data file.
+    // This includes a partially written record at the end of the file and
+    // the complete records of a batch which was not finished.
+    DataRecordsDropped uint64
+
+    // RecordsRebuilt is the number of index records rebuilt from the data
+    // file.
+    RecordsRebuilt uint64
+
+    // BytesTruncated is the number of bytes removed from the end of the data
+    // file.
+    BytesTruncated int64
+
+    // IndexBytesTruncated is the number of bytes removed from the end of the
+    // index file.
+    IndexBytesTruncated int64
+}
+
 // Config stores several log settings. This is used to describe how the log
 // should be opened.
 type Config struct {
@@ -142,4 +387,37 @@ type Config struct {
     Truncate      bool
     TimeToLive    int64
     Strategy      m3.WriteStrategy
+    GroupCommit   GroupCommitPolicy
+
+    // Compressor compresses the data of each record. Records which do not
+    // get smaller are written uncompressed. Compression is disabled when it
+    // is nil.
+    Compressor Compressor
+
+    // KeyProvider supplies the keys which encrypt the data of each record.
+    // Records are compressed before they are encrypted. Encryption is
+    // disabled when it is nil.
+    KeyProvider KeyProvider
+
+    // TombstoneRetention is how long compaction keeps a tombstone, a keyed
+    // record without data, after it was written. Tombstones are kept while
+    // they are the newest record with their key so cursors reading the log
+    // see the key was deleted.
+    TombstoneRetention time.Duration
+}
+
+// GroupCommitPolicy describes how concurrent writes are grouped together.
+// When group commit is enabled, records from concurrent `Write` calls are
+// written to the data and index files as one batch which is synced once. Each
+// `Write` returns after its record has been synced. Group commit is disabled
+// when `MaxRecords` is 0.
+type GroupCommitPolicy struct {
+
+    // MaxRecords is the largest number of records written in one batch.
+    MaxRecords int
+
+    // MaxWait is how long the first record in a batch waits for more records
+    // before the batch is written. If it is 0, a batch only contains the
+    // records which are already waiting.
+    MaxWait time.Duration
 }
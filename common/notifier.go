@@ -0,0 +1,36 @@
+package common
+
+import "sync"
+
+// ## **Notifier**
+
+// Notifier wakes goroutines waiting for a log to change. A goroutine gets
+// a channel from Wait before checking the log and waits for the channel to be
+// closed. Notify closes the channel given to every waiting goroutine. The
+// zero value is ready to use.
+type Notifier struct {
+    mutex   sync.Mutex
+    channel chan struct{}
+}
+
+// Wait returns a channel which is closed by the next call to Notify.
+func (n *Notifier) Wait() <-chan struct{} {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.channel == nil {
+        n.channel = make(chan struct{})
+    }
+    return n.channel
+}
+
+// Notify wakes every goroutine waiting on a channel returned by Wait.
+func (n *Notifier) Notify() {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.channel != nil {
+        close(n.channel)
+        n.channel = nil
+    }
+}
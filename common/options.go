@@ -0,0 +1,89 @@
+package common
+
+import "time"
+
+// ## **Cursor Options**
+
+// NewCursorOptions applies the given options to the default cursor options.
+func NewCursorOptions(options ...CursorOption) CursorOptions {
+    var opts CursorOptions
+    for _, option := range options {
+        option(&opts)
+    }
+    return opts
+}
+
+// WithExpired is a cursor option which includes expired records.
+func WithExpired() CursorOption {
+    return func(opts *CursorOptions) {
+        opts.IncludeExpired = true
+    }
+}
+
+// StartAt is a cursor option which starts the cursor at the given record
+// index instead of the first record.
+func StartAt(index uint64) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.Start = index
+    }
+}
+
+// FromEnd is a cursor option which starts the cursor after the last record,
+// for reading the log backwards with Prev.
+func FromEnd() CursorOption {
+    return func(opts *CursorOptions) {
+        opts.FromEnd = true
+    }
+}
+
+// WithCompressor is a cursor option which decompresses records with the
+// given compressor. It is needed by cursors created without a log, such as
+// `v1.NewCursor`.
+func WithCompressor(compressor Compressor) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.Compressor = compressor
+    }
+}
+
+// WithKeyProvider is a cursor option which decrypts records with keys from
+// the given provider.
+func WithKeyProvider(provider KeyProvider) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.KeyProvider = provider
+    }
+}
+
+// Since is a cursor option which starts the cursor's time range at the given
+// time. Moving back with Prev stops at the first record written before it and
+// returns `ErrStartOfLog`.
+func Since(t time.Time) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.Since = t
+    }
+}
+
+// Until is a cursor option which ends the cursor at the first record written
+// at or after the given time. Reading that record returns `ErrEndOfRange`.
+func Until(t time.Time) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.Until = t
+    }
+}
+
+// WithFlags is a cursor option which only includes records whose flags
+// masked with `mask` equal `value`. The flags are checked from the record
+// header, the data of skipped records is not read.
+func WithFlags(mask, value uint32) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.FlagMask = mask
+        opts.FlagValue = value
+    }
+}
+
+// WithFilter is a cursor option which only includes records for which the
+// filter returns true. The filter is called after the flags are checked.
+func WithFilter(filter func(LogRecord) bool) CursorOption {
+    return func(opts *CursorOptions) {
+        opts.Filter = filter
+    }
+}
@@ -0,0 +1,22 @@
+package raft
+
+import "errors"
+
+// ## **Possible Store Errors**
+
+var (
+    // ErrLogNotFound occurs when a Raft log entry is not in the log store.
+    ErrLogNotFound = errors.New("log entry not found")
+
+    // ErrNonContiguousLogs occurs when Raft log entries are stored with an
+    // index which does not follow the last entry in the log store.
+    ErrNonContiguousLogs = errors.New("log entries are not contiguous")
+
+    // ErrInvalidRange occurs when a range of Raft log entries is deleted from
+    // the middle of the log store. Only a prefix or a suffix can be deleted.
+    ErrInvalidRange = errors.New("only a prefix or a suffix of the log can be deleted")
+
+    // ErrInvalidLogEntry occurs when a record cannot be decoded as a Raft log
+    // entry.
+    ErrInvalidLogEntry = errors.New("invalid log entry")
+)
@@ -0,0 +1,114 @@
+// Package raft adapts wallaby logs to the storage used by a Raft
+// implementation. Log entries are stored in a `common.WriteAheadLog`, one
+// entry per record, and term and vote metadata is stored in a separate log.
+package raft
+
+import "github.com/blacklabeldata/xbinary"
+
+// ## **Log Entries**
+
+// LogType describes what a Raft log entry contains.
+type LogType uint8
+
+const (
+
+    // LogCommand is an entry applied to the state machine.
+    LogCommand LogType = iota
+
+    // LogNoop is an entry used by a new leader to commit entries from
+    // previous terms.
+    LogNoop
+
+    // LogBarrier is an entry used to wait until all preceding entries have
+    // been applied.
+    LogBarrier
+
+    // LogConfiguration is an entry which changes the cluster membership.
+    LogConfiguration
+)
+
+// Log is a Raft log entry. Indexes start at 1, an index of 0 means the log
+// is empty.
+type Log struct {
+    Index uint64
+    Term  uint64
+    Type  LogType
+    Data  []byte
+}
+
+// entryHeaderSize is the size of the index, term and type stored before the
+// entry data in each record.
+const entryHeaderSize = 17
+
+// encodeLog encodes a log entry as record data.
+func encodeLog(log *Log) []byte {
+    buffer := make([]byte, entryHeaderSize+len(log.Data))
+    xbinary.LittleEndian.PutUint64(buffer, 0, log.Index)
+    xbinary.LittleEndian.PutUint64(buffer, 8, log.Term)
+    buffer[16] = byte(log.Type)
+    copy(buffer[entryHeaderSize:], log.Data)
+    return buffer
+}
+
+// decodeLog decodes record data into a log entry. The entry data is copied
+// out of the record.
+func decodeLog(data []byte, log *Log) bool {
+    if len(data) < entryHeaderSize {
+        return false
+    }
+
+    log.Index, _ = xbinary.LittleEndian.Uint64(data, 0)
+    log.Term, _ = xbinary.LittleEndian.Uint64(data, 8)
+    log.Type = LogType(data[16])
+    log.Data = append([]byte(nil), data[entryHeaderSize:]...)
+    return true
+}
+
+// ## **Storage Contracts**
+
+// LogStore stores Raft log entries. Entries are stored in index order
+// without gaps.
+type LogStore interface {
+
+    // FirstIndex returns the index of the first entry, or 0 if the store is
+    // empty.
+    FirstIndex() (uint64, error)
+
+    // LastIndex returns the index of the last entry, or 0 if the store is
+    // empty.
+    LastIndex() (uint64, error)
+
+    // GetLog reads the entry with the given index into `log`.
+    // `ErrLogNotFound` is returned if the entry is not in the store.
+    GetLog(index uint64, log *Log) error
+
+    // StoreLog stores a single entry.
+    StoreLog(log *Log) error
+
+    // StoreLogs stores several entries atomically. The first entry must
+    // follow the last entry in the store, unless the store is empty.
+    StoreLogs(logs []*Log) error
+
+    // DeleteRange deletes the entries with indexes from `min` to `max`,
+    // inclusive.
+    DeleteRange(min, max uint64) error
+}
+
+// StableStore stores Raft metadata such as the current term and the last
+// vote.
+type StableStore interface {
+
+    // Set stores the value of a key.
+    Set(key []byte, value []byte) error
+
+    // Get returns the value of a key. `common.ErrKeyNotFound` is returned if
+    // the key has not been set.
+    Get(key []byte) ([]byte, error)
+
+    // SetUint64 stores an integer value of a key.
+    SetUint64(key []byte, value uint64) error
+
+    // GetUint64 returns the integer value of a key. `common.ErrKeyNotFound` is
+    // returned if the key has not been set.
+    GetUint64(key []byte) (uint64, error)
+}
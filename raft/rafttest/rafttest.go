@@ -0,0 +1,117 @@
+// Package rafttest provides conformance tests for implementations of the raft
+// log and stable stores.
+package rafttest
+
+import (
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/wallaby/raft"
+    "github.com/stretchr/testify/assert"
+)
+
+// ## **Conformance Tests**
+
+// LogStoreSuite checks that a LogStore follows the contract. The store must
+// be empty. Other LogStore implementations can run it from their own tests.
+func LogStoreSuite(t *testing.T, store raft.LogStore) {
+    var entry raft.Log
+
+    // empty store
+    first, err := store.FirstIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), first)
+    last, err := store.LastIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), last)
+    assert.Equal(t, raft.ErrLogNotFound, store.GetLog(1, &entry))
+
+    // single entries and batches
+    assert.Nil(t, store.StoreLog(&raft.Log{Index: 1, Term: 1, Type: raft.LogConfiguration, Data: []byte("config")}))
+    assert.Nil(t, store.StoreLogs(Logs(2, 9, 1)))
+    AssertIndexes(t, store, 1, 10)
+
+    assert.Nil(t, store.GetLog(1, &entry))
+    assert.Equal(t, raft.Log{Index: 1, Term: 1, Type: raft.LogConfiguration, Data: []byte("config")}, entry)
+    for i := uint64(2); i <= 10; i++ {
+        assert.Nil(t, store.GetLog(i, &entry))
+        assert.Equal(t, *Logs(i, 1, 1)[0], entry)
+    }
+    assert.Equal(t, raft.ErrLogNotFound, store.GetLog(11, &entry))
+
+    // entries must follow the last entry
+    assert.Equal(t, raft.ErrNonContiguousLogs, store.StoreLog(Logs(12, 1, 1)[0]))
+    assert.Equal(t, raft.ErrNonContiguousLogs, store.StoreLog(Logs(10, 1, 1)[0]))
+    assert.Equal(t, raft.ErrNonContiguousLogs, store.StoreLogs([]*raft.Log{Logs(11, 1, 1)[0], Logs(13, 1, 1)[0]}))
+    AssertIndexes(t, store, 1, 10)
+
+    // a conflicting suffix is replaced by entries from a new term
+    assert.Nil(t, store.DeleteRange(8, 10))
+    AssertIndexes(t, store, 1, 7)
+    assert.Equal(t, raft.ErrLogNotFound, store.GetLog(8, &entry))
+    assert.Nil(t, store.StoreLogs(Logs(8, 5, 2)))
+    AssertIndexes(t, store, 1, 12)
+    assert.Nil(t, store.GetLog(8, &entry))
+    assert.Equal(t, *Logs(8, 1, 2)[0], entry)
+
+    // a compacted prefix
+    assert.Nil(t, store.DeleteRange(0, 5))
+    AssertIndexes(t, store, 6, 12)
+    assert.Equal(t, raft.ErrLogNotFound, store.GetLog(5, &entry))
+    assert.Nil(t, store.GetLog(6, &entry))
+    assert.Equal(t, *Logs(6, 1, 1)[0], entry)
+
+    // only a prefix or a suffix can be deleted
+    assert.Equal(t, raft.ErrInvalidRange, store.DeleteRange(8, 9))
+    AssertIndexes(t, store, 6, 12)
+
+    // deleting every entry lets the store start again at any index
+    assert.Nil(t, store.DeleteRange(6, 12))
+    AssertIndexes(t, store, 0, 0)
+    assert.Equal(t, raft.ErrLogNotFound, store.GetLog(6, &entry))
+    assert.Nil(t, store.StoreLogs(Logs(100, 3, 3)))
+    AssertIndexes(t, store, 100, 102)
+    assert.Nil(t, store.GetLog(101, &entry))
+    assert.Equal(t, *Logs(101, 1, 3)[0], entry)
+}
+
+// StableStoreSuite checks that a StableStore follows the contract. The store
+// must be empty.
+func StableStoreSuite(t *testing.T, store raft.StableStore) {
+    _, err := store.Get([]byte("vote"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, err = store.GetUint64([]byte("term"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    // the last value wins
+    assert.Nil(t, store.Set([]byte("vote"), []byte("node-1")))
+    assert.Nil(t, store.Set([]byte("vote"), []byte("node-2")))
+    value, err := store.Get([]byte("vote"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("node-2"), value)
+
+    assert.Nil(t, store.SetUint64([]byte("term"), 1))
+    assert.Nil(t, store.SetUint64([]byte("term"), 1<<40))
+    term, err := store.GetUint64([]byte("term"))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1<<40), term)
+}
+
+// Logs creates `count` command entries starting at the given index.
+func Logs(index, count, term uint64) []*raft.Log {
+    logs := make([]*raft.Log, count)
+    for i := range logs {
+        logs[i] = &raft.Log{Index: index + uint64(i), Term: term, Type: raft.LogCommand, Data: []byte{byte(index) + byte(i), byte(term)}}
+    }
+    return logs
+}
+
+// AssertIndexes checks the first and last index of a store.
+func AssertIndexes(t *testing.T, store raft.LogStore, first, last uint64) {
+    index, err := store.FirstIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, first, index, "first index")
+    index, err = store.LastIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, last, index, "last index")
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+    "sync"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// WALStableStore implements the StableStore interface on a write-ahead log.
+// Every Set appends a record holding the key and the value, and the values
+// are kept in memory. When the store is opened the records are read in order
+// so the last value written for each key wins.
+//
+// Each record is the key length as a 4-byte integer followed by the key and
+// the value.
+//
+// Old values are never removed, so the log grows by one record for every
+// Set. Raft only sets the term and the vote, which change rarely, but a
+// store which is set often should be copied to a new log from time to time.
+type WALStableStore struct {
+    mutex  sync.RWMutex
+    log    common.WriteAheadLog
+    syncer common.Syncer
+    values map[string][]byte
+}
+
+// NewStableStore creates a stable store on the given log and reads the values
+// already stored in it. The store does not own the log. The log must
+// implement `common.Syncer` so every value can be synced before Set returns,
+// otherwise `common.ErrSyncUnsupported` is returned.
+func NewStableStore(log common.WriteAheadLog) (*WALStableStore, error) {
+    syncer, ok := log.(common.Syncer)
+    if !ok {
+        return nil, common.ErrSyncUnsupported
+    }
+
+    cursor, err := log.Cursor(common.WithExpired())
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close()
+
+    store := &WALStableStore{log: log, syncer: syncer, values: make(map[string][]byte)}
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        key, value, ok := decodeValue(record.Data())
+        if !ok {
+            return nil, ErrInvalidLogEntry
+        }
+        store.values[string(key)] = value
+    }
+    if err != common.ErrEndOfLog {
+        return nil, err
+    }
+    return store, nil
+}
+
+// encodeValue encodes a key and a value as record data.
+func encodeValue(key, value []byte) []byte {
+    buffer := make([]byte, 4+len(key)+len(value))
+    xbinary.LittleEndian.PutUint32(buffer, 0, uint32(len(key)))
+    copy(buffer[4:], key)
+    copy(buffer[4+len(key):], value)
+    return buffer
+}
+
+// decodeValue decodes record data into a key and a value. Both are copied out
+// of the record.
+func decodeValue(data []byte) ([]byte, []byte, bool) {
+    size, err := xbinary.LittleEndian.Uint32(data, 0)
+    if err != nil || uint64(len(data)-4) < uint64(size) {
+        return nil, nil, false
+    }
+
+    key := append([]byte(nil), data[4:4+size]...)
+    value := append([]byte(nil), data[4+size:]...)
+    return key, value, true
+}
+
+// Set stores the value of a key. The value is written to the log and synced
+// to permanent storage before it is visible to Get, whatever the write
+// strategy of the log is.
+func (s *WALStableStore) Set(key []byte, value []byte) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if _, err := s.log.Write(encodeValue(key, value)); err != nil {
+        return err
+    } else if err := s.syncer.Sync(); err != nil {
+        return err
+    }
+    s.values[string(key)] = append([]byte(nil), value...)
+    return nil
+}
+
+// Get returns the value of a key. `common.ErrKeyNotFound` is returned if the
+// key has not been set.
+func (s *WALStableStore) Get(key []byte) ([]byte, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    value, ok := s.values[string(key)]
+    if !ok {
+        return nil, common.ErrKeyNotFound
+    }
+    return append([]byte(nil), value...), nil
+}
+
+// SetUint64 stores an integer value of a key as 8 little endian bytes.
+func (s *WALStableStore) SetUint64(key []byte, value uint64) error {
+    buffer := make([]byte, 8)
+    xbinary.LittleEndian.PutUint64(buffer, 0, value)
+    return s.Set(key, buffer)
+}
+
+// GetUint64 returns the integer value of a key. `common.ErrKeyNotFound` is
+// returned if the key has not been set.
+func (s *WALStableStore) GetUint64(key []byte) (uint64, error) {
+    value, err := s.Get(key)
+    if err != nil {
+        return 0, err
+    }
+
+    result, err := xbinary.LittleEndian.Uint64(value, 0)
+    if err != nil {
+        return 0, ErrInvalidLogEntry
+    }
+    return result, nil
+}
@@ -0,0 +1,219 @@
+package raft
+
+import (
+    "sync"
+
+    "github.com/blacklabeldata/wallaby/common"
+)
+
+// WALLogStore implements the LogStore interface on a write-ahead log. Each
+// entry is stored as one record and entries are stored in index order, so an
+// entry is found by the distance between its index and the index of its
+// record.
+//
+// Deleting a prefix uses `TruncateBefore` and deleting a suffix uses
+// `TruncateAfter`. Logs which only remove whole files when truncating before a
+// record, such as segmented logs, may keep some of the deleted entries on
+// disk. Those entries are hidden until the store is opened again.
+type WALLogStore struct {
+    mutex  sync.Mutex
+    log    common.WriteAheadLog
+    cursor common.LogCursor
+
+    // first and last are the indexes of the first and last entries, both are
+    // 0 if the store is empty
+    first uint64
+    last  uint64
+
+    // offset is the entry index minus the record index
+    offset uint64
+}
+
+// NewLogStore creates a log store on the given log. The log is expected to
+// only contain Raft log entries. The store does not own the log; closing the
+// store leaves the log open.
+func NewLogStore(log common.WriteAheadLog) (*WALLogStore, error) {
+
+    // expired records are still entries
+    cursor, err := log.Cursor(common.WithExpired())
+    if err != nil {
+        return nil, err
+    }
+
+    store := &WALLogStore{log: log, cursor: cursor}
+    if err := store.load(); err != nil {
+        cursor.Close()
+        return nil, err
+    }
+    return store, nil
+}
+
+// load reads the first entry in the log. The last entry follows from the
+// number of records, since entries are stored without gaps.
+func (s *WALLogStore) load() error {
+    record, err := s.cursor.Seek(0)
+    if err == common.ErrEndOfLog {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    var entry Log
+    if !decodeLog(record.Data(), &entry) {
+        return ErrInvalidLogEntry
+    }
+
+    meta, err := s.log.Metadata()
+    if err != nil {
+        return err
+    }
+
+    // the cursor has moved past the first record
+    s.offset = entry.Index - (s.cursor.Position() - 1)
+    s.first = entry.Index
+    s.last = s.offset + meta.Records - 1
+    return nil
+}
+
+// FirstIndex returns the index of the first entry, or 0 if the store is
+// empty.
+func (s *WALLogStore) FirstIndex() (uint64, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.first, nil
+}
+
+// LastIndex returns the index of the last entry, or 0 if the store is empty.
+func (s *WALLogStore) LastIndex() (uint64, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.last, nil
+}
+
+// GetLog reads the entry with the given index into `log`.
+// `ErrLogNotFound` is returned if the entry is not in the store.
+func (s *WALLogStore) GetLog(index uint64, log *Log) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.first == 0 || index < s.first || index > s.last {
+        return ErrLogNotFound
+    }
+
+    record, err := s.cursor.Seek(index - s.offset)
+    if err == common.ErrEndOfLog {
+        return ErrLogNotFound
+    } else if err != nil {
+        return err
+    }
+
+    // the record must hold the requested entry
+    var entry Log
+    if !decodeLog(record.Data(), &entry) || entry.Index != index {
+        return ErrInvalidLogEntry
+    }
+
+    *log = entry
+    return nil
+}
+
+// StoreLog stores a single entry.
+func (s *WALLogStore) StoreLog(log *Log) error {
+    return s.StoreLogs([]*Log{log})
+}
+
+// StoreLogs stores several entries as an atomic batch.
+// `ErrNonContiguousLogs` is returned if the entries do not follow the
+// last entry in the store or each other.
+func (s *WALLogStore) StoreLogs(logs []*Log) error {
+    if len(logs) == 0 {
+        return nil
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    // an empty store starts at any index except 0
+    next := s.last + 1
+    if s.first == 0 {
+        next = logs[0].Index
+        if next == 0 {
+            return ErrInvalidLogEntry
+        }
+    }
+
+    records := make([][]byte, len(logs))
+    for i, log := range logs {
+        if log.Index != next+uint64(i) {
+            return ErrNonContiguousLogs
+        }
+        records[i] = encodeLog(log)
+    }
+
+    // the first entry of an empty store goes into the next record
+    offset := s.offset
+    if s.first == 0 {
+        meta, err := s.log.Metadata()
+        if err != nil {
+            return err
+        }
+        offset = next - meta.Records
+    }
+
+    if _, err := s.log.WriteBatch(records); err != nil {
+        return err
+    }
+
+    if s.first == 0 {
+        s.first = next
+        s.offset = offset
+    }
+    s.last = logs[len(logs)-1].Index
+    return nil
+}
+
+// DeleteRange deletes the entries with indexes from `min` to `max`,
+// inclusive. Only a prefix or a suffix of the store can be deleted,
+// `ErrInvalidRange` is returned for a range in the middle.
+func (s *WALLogStore) DeleteRange(min, max uint64) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    // nothing to delete
+    if s.first == 0 || min > max || max < s.first || min > s.last {
+        return nil
+    }
+
+    switch {
+
+    // every entry
+    case min <= s.first && max >= s.last:
+        if err := s.log.TruncateBefore(s.last - s.offset + 1); err != nil {
+            return err
+        }
+        s.first, s.last = 0, 0
+
+    // a prefix
+    case min <= s.first:
+        if err := s.log.TruncateBefore(max - s.offset + 1); err != nil {
+            return err
+        }
+        s.first = max + 1
+
+    // a suffix
+    case max >= s.last:
+        if err := s.log.TruncateAfter(min - s.offset - 1); err != nil {
+            return err
+        }
+        s.last = min - 1
+
+    default:
+        return ErrInvalidRange
+    }
+    return nil
+}
+
+// Close closes the cursor used to read entries. The log is left open.
+func (s *WALLogStore) Close() error {
+    return s.cursor.Close()
+}
@@ -0,0 +1,126 @@
+package raft_test
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/wallaby/raft"
+    "github.com/blacklabeldata/wallaby/raft/rafttest"
+    "github.com/blacklabeldata/wallaby/segment"
+    "github.com/blacklabeldata/wallaby/v1"
+    "github.com/stretchr/testify/assert"
+)
+
+// createTestDir creates a temporary directory for the test logs.
+func createTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "wallaby-raft")
+    assert.Nil(t, err, "Test dir could not be created")
+    return dir
+}
+
+// openTestLog opens a single file log in the given directory.
+func openTestLog(t *testing.T, dir, name string) common.WriteAheadLog {
+    log, err := wallaby.Create(filepath.Join(dir, name), v1.DefaultConfig)
+    assert.Nil(t, err)
+    return log
+}
+
+func TestLogStore(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, "raft.log")
+    defer log.Close()
+
+    store, err := raft.NewLogStore(log)
+    assert.Nil(t, err)
+    defer store.Close()
+    rafttest.LogStoreSuite(t, store)
+}
+
+func TestLogStoreSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := segment.Open(dir, v1.DefaultConfig, segment.Policy{MaxRecords: 3})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    store, err := raft.NewLogStore(log)
+    assert.Nil(t, err)
+    defer store.Close()
+    rafttest.LogStoreSuite(t, store)
+}
+
+func TestLogStoreReopen(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, "raft.log")
+    store, err := raft.NewLogStore(log)
+    assert.Nil(t, err)
+    assert.Nil(t, store.StoreLogs(rafttest.Logs(5, 10, 1)))
+    assert.Nil(t, store.DeleteRange(5, 7))
+    assert.Nil(t, store.DeleteRange(13, 14))
+    assert.Nil(t, store.Close())
+    assert.Nil(t, log.Close())
+
+    // the indexes are read back from the log
+    log = openTestLog(t, dir, "raft.log")
+    defer log.Close()
+    store, err = raft.NewLogStore(log)
+    assert.Nil(t, err)
+    defer store.Close()
+    rafttest.AssertIndexes(t, store, 8, 12)
+
+    var entry raft.Log
+    assert.Nil(t, store.GetLog(12, &entry))
+    assert.Equal(t, *rafttest.Logs(12, 1, 1)[0], entry)
+    assert.Nil(t, store.StoreLog(rafttest.Logs(13, 1, 2)[0]))
+    rafttest.AssertIndexes(t, store, 8, 13)
+}
+
+func TestStableStore(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, "stable.log")
+    store, err := raft.NewStableStore(log)
+    assert.Nil(t, err)
+    rafttest.StableStoreSuite(t, store)
+    assert.Nil(t, log.Close())
+
+    // the last values are read back from the log
+    log = openTestLog(t, dir, "stable.log")
+    defer log.Close()
+    store, err = raft.NewStableStore(log)
+    assert.Nil(t, err)
+
+    value, err := store.Get([]byte("vote"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("node-2"), value)
+    term, err := store.GetUint64([]byte("term"))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1<<40), term)
+
+    // logs which cannot be synced are rejected
+    _, err = raft.NewStableStore(struct{ common.WriteAheadLog }{log})
+    assert.Equal(t, common.ErrSyncUnsupported, err)
+}
+
+func TestStableStoreSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := segment.Open(dir, v1.DefaultConfig, segment.Policy{MaxRecords: 1})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    store, err := raft.NewStableStore(log)
+    assert.Nil(t, err)
+    rafttest.StableStoreSuite(t, store)
+}
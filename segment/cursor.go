@@ -0,0 +1,223 @@
+package segment
+
+import (
+    "context"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+)
+
+// cursor implements the LogCursor interface across all the segments of a
+// log. It holds a cursor for the segment containing the current position and
+// replaces it when the position moves into another segment.
+type cursor struct {
+    log      *Log
+    options  []common.CursorOption
+    segment  *segment
+    current  common.LogCursor
+    position uint64
+    synced   bool
+}
+
+// Seek moves the cursor to the given record index and returns the record.
+func (c *cursor) Seek(offset uint64) (common.LogRecord, error) {
+    c.position = offset
+    c.synced = false
+    return c.Next()
+}
+
+// SeekTime moves the cursor to the first record written at or after the
+// given time and returns the record.
+func (c *cursor) SeekTime(t time.Time) (common.LogRecord, error) {
+    position, err := c.search(t)
+    if err != nil {
+        return nil, err
+    }
+    return c.Seek(position)
+}
+
+// search finds the first record written at or after the given time. Each
+// segment is searched in order until one contains such a record. The record
+// index after the last record is returned if every record is older.
+func (c *cursor) search(t time.Time) (uint64, error) {
+    c.log.mutex.RLock()
+    defer c.log.mutex.RUnlock()
+
+    if c.log.state == common.CLOSED {
+        return 0, common.ErrLogClosed
+    }
+
+    for _, seg := range c.log.segments {
+        if err := c.open(seg, 0); err != nil {
+            return 0, err
+        }
+
+        // the segment cursor stays on the record when the time range ends
+        _, err := c.current.SeekTime(t)
+        if err == nil {
+            return seg.base + c.current.Position() - 1, nil
+        } else if err == common.ErrEndOfRange {
+            return seg.base + c.current.Position(), nil
+        } else if err != common.ErrEndOfLog {
+            return 0, err
+        }
+    }
+
+    active := c.log.active()
+    return active.base + active.records, nil
+}
+
+// Next reads the record at the current position and moves the cursor forward
+// one record. When the end of a sealed segment is reached the cursor moves
+// into the next segment. `ErrEndOfLog` is returned if the record has not been
+// written yet.
+func (c *cursor) Next() (common.LogRecord, error) {
+    c.log.mutex.RLock()
+    defer c.log.mutex.RUnlock()
+
+    if c.log.state == common.CLOSED {
+        return nil, common.ErrLogClosed
+    }
+
+    for {
+
+        // move past records in segments which have been removed
+        if first := c.log.segments[0].base; c.position < first {
+            c.position = first
+            c.synced = false
+        }
+
+        // open a cursor for the segment containing the position
+        seg := c.log.find(c.position)
+        if c.current == nil || seg != c.segment {
+            if err := c.open(seg, c.position-seg.base); err != nil {
+                return nil, err
+            }
+        }
+
+        // read the record from the segment
+        var record common.LogRecord
+        var err error
+        if c.synced {
+            record, err = c.current.Next()
+        } else {
+            record, err = c.current.Seek(c.position - seg.base)
+        }
+
+        // the segment cursor may have skipped expired records
+        c.position = seg.base + c.current.Position()
+        c.synced = err == nil
+        if err == nil {
+            return record, nil
+        }
+
+        // continue with the next segment at the end of a sealed segment
+        if err != common.ErrEndOfLog || seg == c.log.active() {
+            return nil, err
+        } else if end := seg.base + seg.records; c.position < end {
+            c.position = end
+        }
+    }
+}
+
+// Prev moves the cursor back one record and returns the record before the
+// current position. When the start of a segment is reached the cursor moves
+// into the previous segment. `ErrStartOfLog` is returned at the first record
+// of the first segment or at the start of the time range.
+func (c *cursor) Prev() (common.LogRecord, error) {
+    c.log.mutex.RLock()
+    defer c.log.mutex.RUnlock()
+
+    if c.log.state == common.CLOSED {
+        return nil, common.ErrLogClosed
+    }
+
+    // move before records which have been removed from the end
+    if active := c.log.active(); c.position > active.base+active.records {
+        c.position = active.base + active.records
+        c.synced = false
+    }
+
+    for c.position > c.log.segments[0].base {
+        seg := c.log.find(c.position - 1)
+
+        // the segment cursor must be at the same position to move back
+        if c.current == nil || seg != c.segment || c.current.Position() != c.position-seg.base {
+            if err := c.open(seg, c.position-seg.base); err != nil {
+                return nil, err
+            }
+        }
+
+        // the segment cursor may have skipped expired records
+        record, err := c.current.Prev()
+        c.position = seg.base + c.current.Position()
+        c.synced = err == nil
+        if err == nil {
+            return record, nil
+        } else if err != common.ErrStartOfLog || c.position > seg.base {
+
+            // the segment cursor stopped before the start of the segment at
+            // the start of the time range
+            return nil, err
+        }
+    }
+    return nil, common.ErrStartOfLog
+}
+
+// NextWait reads the record at the current position like Next. If the
+// record has not been written yet it waits for the log to append it or for
+// the context to be cancelled.
+func (c *cursor) NextWait(ctx context.Context) (common.LogRecord, error) {
+    for {
+
+        // get the channel first, a write during Next closes it
+        wait := c.log.notifier.Wait()
+        record, err := c.Next()
+        if err != common.ErrEndOfLog {
+            return record, err
+        }
+
+        select {
+        case <-wait:
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Position returns the index of the record read by the next call to Next.
+func (c *cursor) Position() uint64 {
+    return c.position
+}
+
+// open replaces the current segment cursor with a cursor for the given
+// segment, starting at the given record index within the segment.
+func (c *cursor) open(seg *segment, start uint64) error {
+    if c.current != nil {
+        c.current.Close()
+        c.current = nil
+    }
+
+    // the start replaces the position options of the log cursor
+    options := append(c.options[:len(c.options):len(c.options)], func(opts *common.CursorOptions) {
+        opts.Start = start
+        opts.FromEnd = false
+    })
+    current, err := seg.log.Cursor(options...)
+    if err != nil {
+        return err
+    }
+
+    c.current = current
+    c.segment = seg
+    c.synced = false
+    return nil
+}
+
+// Close closes the current segment cursor.
+func (c *cursor) Close() error {
+    if c.current == nil {
+        return nil
+    }
+    return c.current.Close()
+}
@@ -0,0 +1,880 @@
+// Package segment manages a directory of numbered log segments and presents
+// them as a single write-ahead log.
+//
+// Each segment is a regular wallaby log, a data file plus an `.idx` file,
+// named after the index of its first record. Records are always appended to
+// the last segment, the active segment. When the active segment exceeds the
+// configured size, record count or age a new segment is started. Record
+// indexes are continuous across segments.
+package segment
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/OneOfOne/xxhash"
+    "github.com/blacklabeldata/wallaby"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// SegmentExtension is the file extension of segment data files.
+const SegmentExtension = ".log"
+
+// Policy describes when the active segment is rolled over to a new segment. A
+// zero value for any of the limits disables it.
+type Policy struct {
+
+    // MaxBytes is the maximum size of a segment data file
+    MaxBytes int64
+
+    // MaxRecords is the maximum number of records in a segment
+    MaxRecords uint64
+
+    // MaxAge is the maximum time between the first record in a segment and
+    // the current time
+    MaxAge time.Duration
+
+    // ReclaimInterval is how often expired segments are removed in the
+    // background. Segments are only reclaimed when the log has a TTL.
+    ReclaimInterval time.Duration
+}
+
+// segment is a single log in the segment directory.
+type segment struct {
+    base      uint64
+    records   uint64
+    firstTime int64
+    filename  string
+    log       common.WriteAheadLog
+}
+
+// Log implements the `common.WriteAheadLog` interface over a directory of
+// segments. All the segments remain open while the log is open.
+type Log struct {
+    dir      string
+    config   common.Config
+    policy   Policy
+    mutex    sync.RWMutex
+    segments []*segment
+    state    common.State
+    notifier common.Notifier
+    done     chan struct{}
+}
+
+// Open opens the segmented log in the given directory, creating the
+// directory and the first segment if they do not exist. Every segment is
+// opened with `wallaby.Create` and the given config. If `config.Truncate` is
+// set all existing segments are removed.
+func Open(dir string, config common.Config, policy Policy) (*Log, error) {
+
+    // create the directory if it does not exist
+    err := os.MkdirAll(dir, os.ModeDir|0700)
+    if err != nil {
+        return nil, err
+    }
+
+    // find the existing segments
+    bases, err := listSegments(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    // remove all existing segments if the log should be truncated
+    if config.Truncate {
+        for _, base := range bases {
+            filename := segmentFilename(dir, base)
+            if err := os.Remove(filename); err != nil {
+                return nil, err
+            }
+            for _, suffix := range []string{".idx", ".keys"} {
+                if err := os.Remove(filename + suffix); err != nil && !os.IsNotExist(err) {
+                    return nil, err
+                }
+            }
+        }
+        bases = nil
+        config.Truncate = false
+    }
+
+    l := &Log{dir: dir, config: config, policy: policy}
+
+    // open all existing segments and verify record indexes are continuous
+    for _, base := range bases {
+        seg, err := l.openSegment(base)
+        if err != nil {
+            l.Close()
+            return nil, err
+        }
+
+        if n := len(l.segments); n > 0 {
+            last := l.segments[n-1]
+            if last.base+last.records != base {
+                seg.log.Close()
+                l.Close()
+                return nil, common.ErrSegmentGap
+            }
+        }
+        l.segments = append(l.segments, seg)
+    }
+
+    // create the first segment for a new log
+    if len(l.segments) == 0 {
+        seg, err := l.openSegment(0)
+        if err != nil {
+            return nil, err
+        }
+        l.segments = append(l.segments, seg)
+    }
+
+    l.state = common.OPEN
+
+    // start removing expired segments in the background
+    if policy.ReclaimInterval > 0 && config.TimeToLive > 0 {
+        l.done = make(chan struct{})
+        go l.reclaimer(policy.ReclaimInterval, l.done)
+    }
+    return l, nil
+}
+
+// listSegments returns the base record index of every segment in the given
+// directory in ascending order.
+func listSegments(dir string) ([]uint64, error) {
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var bases []uint64
+    for _, file := range files {
+        name := file.Name()
+        if file.IsDir() || !strings.HasSuffix(name, SegmentExtension) {
+            continue
+        }
+
+        base, err := strconv.ParseUint(strings.TrimSuffix(name, SegmentExtension), 10, 64)
+        if err != nil {
+            continue
+        }
+        bases = append(bases, base)
+    }
+
+    sort.Sort(uint64Slice(bases))
+    return bases, nil
+}
+
+// segmentFilename returns the data file name of the segment starting at the
+// given record index.
+func segmentFilename(dir string, base uint64) string {
+    return filepath.Join(dir, fmt.Sprintf("%020d%s", base, SegmentExtension))
+}
+
+// openSegment opens or creates the segment starting at the given record
+// index.
+func (l *Log) openSegment(base uint64) (*segment, error) {
+    filename := segmentFilename(l.dir, base)
+    log, err := wallaby.Create(filename, l.config)
+    if err != nil {
+        return nil, err
+    }
+
+    seg := &segment{base: base, filename: filename, log: log}
+    if err := seg.refresh(); err != nil {
+        log.Close()
+        return nil, err
+    }
+    return seg, nil
+}
+
+// refresh reads the number of records and the time of the first record from
+// the segment. If compaction removed every record the time of the last
+// record is used instead.
+func (s *segment) refresh() error {
+    meta, err := s.log.Metadata()
+    if err != nil {
+        return err
+    }
+    s.records = meta.Records
+    s.firstTime = 0
+
+    if s.records > 0 {
+        cursor, err := s.log.Cursor(common.WithExpired())
+        if err != nil {
+            return err
+        }
+        defer cursor.Close()
+
+        record, err := cursor.Next()
+        if err == common.ErrEndOfLog {
+            s.firstTime = meta.LastModifiedTime
+        } else if err != nil {
+            return err
+        } else {
+            s.firstTime = record.Time()
+        }
+    }
+    return nil
+}
+
+// active returns the segment records are appended to.
+func (l *Log) active() *segment {
+    return l.segments[len(l.segments)-1]
+}
+
+// shouldRoll determines if the active segment exceeds any of the policy
+// limits. Empty segments are never rolled.
+func (l *Log) shouldRoll(now int64) (bool, error) {
+    active := l.active()
+    if active.records == 0 {
+        return false, nil
+    }
+
+    if l.policy.MaxRecords > 0 && active.records >= l.policy.MaxRecords {
+        return true, nil
+    }
+
+    if l.policy.MaxAge > 0 && now-active.firstTime >= int64(l.policy.MaxAge) {
+        return true, nil
+    }
+
+    if l.policy.MaxBytes > 0 {
+        meta, err := active.log.Metadata()
+        if err != nil {
+            return false, err
+        }
+        return meta.Size >= l.policy.MaxBytes, nil
+    }
+    return false, nil
+}
+
+// roll starts a new active segment after the current one.
+func (l *Log) roll() error {
+    active := l.active()
+    seg, err := l.openSegment(active.base + active.records)
+    if err != nil {
+        return err
+    }
+    l.segments = append(l.segments, seg)
+    return nil
+}
+
+// Write appends a record to the active segment, rolling to a new segment
+// first if the active segment exceeds the policy.
+func (l *Log) Write(data []byte) (int, error) {
+    return l.WriteBatch([][]byte{data})
+}
+
+// Append appends a record with the default flags to the active segment and
+// returns its record index.
+func (l *Log) Append(data []byte) (uint64, error) {
+    return l.AppendWithFlags(l.config.Flags, data)
+}
+
+// AppendWithFlags appends a record with the given flags to the active
+// segment and returns its record index.
+func (l *Log) AppendWithFlags(flags uint32, data []byte) (uint64, error) {
+    var index uint64
+    err := l.append(1, func(active *segment) (err error) {
+        index, err = active.log.AppendWithFlags(flags, data)
+        index += active.base
+        return
+    })
+    return index, err
+}
+
+// AppendKeyed appends a record with a key to the active segment and returns
+// its record index. Each segment has its own key index.
+func (l *Log) AppendKeyed(key, data []byte) (uint64, error) {
+    var index uint64
+    err := l.append(1, func(active *segment) (err error) {
+        index, err = active.log.AppendKeyed(key, data)
+        index += active.base
+        return
+    })
+    return index, err
+}
+
+// GetLatest returns the newest record with the given key. The key indexes of
+// the segments are searched from the newest segment to the oldest.
+func (l *Log) GetLatest(key []byte) (common.LogRecord, error) {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return nil, common.ErrLogClosed
+    }
+
+    for i := len(l.segments) - 1; i >= 0; i-- {
+        record, err := l.segments[i].log.GetLatest(key)
+        if err != common.ErrKeyNotFound {
+            return record, err
+        }
+    }
+    return nil, common.ErrKeyNotFound
+}
+
+// Compact compacts the sealed segments by key. The newest record with each
+// key is found in all the segments first, so a sealed segment also drops the
+// records which were replaced by a record in a later segment. The active
+// segment is not compacted. Segments keep their record indexes.
+func (l *Log) Compact() error {
+    latest, err := common.LatestKeys(l)
+    if err != nil {
+        return err
+    }
+
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    for _, seg := range l.segments[:len(l.segments)-1] {
+        compactor, ok := seg.log.(common.KeyCompactor)
+        if !ok {
+            return common.ErrCompactionUnsupported
+        } else if err := compactor.CompactKeys(common.NewestKey(latest, seg.base)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// WriteBatch appends the records as an atomic batch to the active segment,
+// rolling to a new segment first if the active segment exceeds the policy.
+// A batch is never split across segments.
+func (l *Log) WriteBatch(records [][]byte) (int, error) {
+    if len(records) == 0 {
+        return 0, nil
+    }
+
+    var n int
+    err := l.append(len(records), func(active *segment) (err error) {
+        n, err = active.log.WriteBatch(records)
+        return
+    })
+    return n, err
+}
+
+// append rolls to a new segment if the active segment exceeds the policy and
+// calls write to append `count` records to the active segment.
+func (l *Log) append(count int, write func(active *segment) error) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+    now := time.Now().UnixNano()
+
+    roll, err := l.shouldRoll(now)
+    if err != nil {
+        return err
+    } else if roll {
+        if err := l.roll(); err != nil {
+            return err
+        }
+    }
+
+    active := l.active()
+    if err := write(active); err != nil {
+        return err
+    }
+
+    if active.records == 0 {
+        active.firstTime = now
+    }
+    active.records += uint64(count)
+    l.notifier.Notify()
+    return nil
+}
+
+// Sync flushes the data and index files of every segment to permanent
+// storage. Segments which cannot be synced return `ErrSyncUnsupported`.
+func (l *Log) Sync() error {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    for _, seg := range l.segments {
+        syncer, ok := seg.log.(common.Syncer)
+        if !ok {
+            return common.ErrSyncUnsupported
+        } else if err := syncer.Sync(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Pipe copies the raw records starting at the record index `offset` into the
+// given writer, crossing segment boundaries as needed. At most `limit`
+// records are copied. `ErrIndexOutOfRange` is returned if the record has been
+// removed with its segment.
+func (l *Log) Pipe(offset, limit uint64, writer io.Writer) error {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    // the records before the first segment have been removed
+    if first := l.segments[0].base; offset < first {
+        return common.ErrIndexOutOfRange
+    }
+
+    // nothing to copy
+    active := l.active()
+    if offset >= active.base+active.records {
+        return common.ErrEndOfLog
+    }
+
+    // copy the records from each segment in turn
+    for limit > 0 && offset < active.base+active.records {
+        seg := l.find(offset)
+        n := seg.base + seg.records - offset
+        if n > limit {
+            n = limit
+        }
+
+        if err := seg.log.Pipe(offset-seg.base, n, writer); err != nil {
+            return err
+        }
+        offset += n
+        limit -= n
+    }
+    return nil
+}
+
+// Ingest appends every record in a raw byte stream created by Pipe. The
+// stream is appended to the active segment as a whole, the policy is only
+// evaluated before the stream is read.
+func (l *Log) Ingest(reader io.Reader) (uint64, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return 0, common.ErrLogClosed
+    }
+
+    roll, err := l.shouldRoll(time.Now().UnixNano())
+    if err != nil {
+        return 0, err
+    } else if roll {
+        if err := l.roll(); err != nil {
+            return 0, err
+        }
+    }
+
+    active := l.active()
+    count, err := active.log.Ingest(reader)
+    if count > 0 {
+        l.notifier.Notify()
+        if err := active.refresh(); err != nil {
+            return count, err
+        }
+    }
+    return count, err
+}
+
+// TruncateAfter removes every record after the given record index. Segments
+// after the one containing the record are removed and the segment containing
+// it is truncated and becomes the active segment. `ErrIndexOutOfRange` is
+// returned if the record is before the first segment.
+func (l *Log) TruncateAfter(index uint64) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    } else if index < l.segments[0].base {
+        return common.ErrIndexOutOfRange
+    }
+
+    // remove the segments after the record, newest first
+    seg := l.find(index)
+    for l.active() != seg {
+        if err := l.active().remove(); err != nil {
+            return err
+        }
+        l.segments = l.segments[:len(l.segments)-1]
+    }
+
+    if err := seg.log.TruncateAfter(index - seg.base); err != nil {
+        return err
+    }
+    return seg.refresh()
+}
+
+// TruncateBefore removes the segments which only contain records before the
+// given record index. Segments are removed whole, so records before the given
+// record index in the segment containing it are kept. Truncating before the
+// end of the log starts a new empty segment so every record is removed.
+// `ErrIndexOutOfRange` is returned if the record index is past the end of the
+// log.
+func (l *Log) TruncateBefore(index uint64) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    active := l.active()
+    if end := active.base + active.records; index > end {
+        return common.ErrIndexOutOfRange
+    } else if index == end && active.records > 0 {
+        if err := l.roll(); err != nil {
+            return err
+        }
+    }
+
+    for len(l.segments) > 1 {
+        seg := l.segments[0]
+        if seg.base+seg.records > index {
+            break
+        }
+
+        if err := seg.remove(); err != nil {
+            return err
+        }
+        l.segments = l.segments[1:]
+    }
+    return nil
+}
+
+// Close stops the background reclaimer and closes every segment. The first
+// error encountered is returned. Closing a closed log returns
+// `ErrLogClosed`.
+func (l *Log) Close() error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return common.ErrLogClosed
+    }
+    l.state = common.CLOSED
+    l.notifier.Notify()
+
+    if l.done != nil {
+        close(l.done)
+    }
+
+    var first error
+    for _, seg := range l.segments {
+        if err := seg.log.Close(); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
+
+// Recover recovers every segment and combines the reports.
+func (l *Log) Recover() (common.RecoveryReport, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    var report common.RecoveryReport
+    if l.state == common.CLOSED {
+        return report, common.ErrLogClosed
+    }
+    for _, seg := range l.segments {
+        r, err := seg.log.Recover()
+        if err != nil {
+            return report, err
+        }
+
+        report.RecordsDropped += r.RecordsDropped
+        report.DataRecordsDropped += r.DataRecordsDropped
+        report.RecordsRebuilt += r.RecordsRebuilt
+        report.BytesTruncated += r.BytesTruncated
+        report.IndexBytesTruncated += r.IndexBytesTruncated
+
+        if err := seg.refresh(); err != nil {
+            return report, err
+        }
+    }
+    return report, nil
+}
+
+// Cursor creates a cursor starting at the first record of the first
+// segment, at the record given with `StartAt`, or after the last record with
+// `FromEnd`. The cursor moves into the next segment when it reaches the end
+// of a segment. The options are given to the cursor of each segment.
+func (l *Log) Cursor(options ...common.CursorOption) (common.LogCursor, error) {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return nil, common.ErrLogClosed
+    }
+
+    // records before the first segment are skipped by Next
+    opts := common.NewCursorOptions(options...)
+    position := opts.Start
+    if opts.FromEnd {
+        active := l.active()
+        position = active.base + active.records
+    }
+    return &cursor{log: l, options: options, position: position}, nil
+}
+
+// Range creates a cursor positioned at the first record written at or after
+// `from` which ends at the first record written at or after `to`.
+func (l *Log) Range(from, to time.Time, options ...common.CursorOption) (common.LogCursor, error) {
+    options = append(options[:len(options):len(options)], common.Since(from), common.Until(to))
+    logCursor, err := l.Cursor(options...)
+    if err != nil {
+        return nil, err
+    }
+
+    c := logCursor.(*cursor)
+    position, err := c.search(from)
+    if err != nil {
+        c.Close()
+        return nil, err
+    }
+    c.position = position
+    c.synced = false
+    return c, nil
+}
+
+// Snapshot combines the snapshots of all the segments. The hash is the XXH64
+// of every segment hash in order and the size is the record index after the
+// last record. Empty segments are left out so rolling a new segment does not
+// change the snapshot.
+func (l *Log) Snapshot() (common.Snapshot, error) {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    hash := xxhash.New64()
+    buffer := make([]byte, 8)
+
+    var nanos int64
+    for _, seg := range l.segments {
+        if seg.records == 0 {
+            continue
+        }
+
+        snapshot, err := seg.log.Snapshot()
+        if err != nil {
+            return nil, err
+        }
+
+        xbinary.LittleEndian.PutUint64(buffer, 0, snapshot.Hash())
+        hash.Write(buffer)
+        nanos = snapshot.Time().UnixNano()
+    }
+    active := l.active()
+    return common.NewSnapshot(nanos, int64(active.base+active.records), hash.Sum64()), nil
+}
+
+// Verify recomputes the hash of the segments before the snapshot's size and
+// compares it with the snapshot hash. `ErrSnapshotMismatch` is returned if
+// the log no longer matches. Removing segments changes the hash, so older
+// snapshots do not match after `TruncateBefore` or `Reclaim` removes a
+// segment.
+func (l *Log) Verify(snapshot common.Snapshot) error {
+    if snapshot.Size() < 0 {
+        return common.ErrSnapshotMismatch
+    }
+
+    hash, err := l.SnapshotHash(uint64(snapshot.Size()))
+    if err == common.ErrIndexOutOfRange {
+        return common.ErrSnapshotMismatch
+    } else if err != nil {
+        return err
+    } else if hash != snapshot.Hash() {
+        return common.ErrSnapshotMismatch
+    }
+    return nil
+}
+
+// SnapshotHash returns the hash a snapshot would have had when the log ended
+// at the given record index. Segments ending before the record index
+// contribute their current hash and the segment containing it contributes the
+// hash of its records before the record index.
+func (l *Log) SnapshotHash(size uint64) (uint64, error) {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    if l.state == common.CLOSED {
+        return 0, common.ErrLogClosed
+    } else if active := l.active(); size < l.segments[0].base || size > active.base+active.records {
+        return 0, common.ErrIndexOutOfRange
+    }
+
+    hash := xxhash.New64()
+    buffer := make([]byte, 8)
+    for _, seg := range l.segments {
+        if seg.base >= size || seg.records == 0 {
+            break
+        }
+
+        var segmentHash uint64
+        if end := seg.base + seg.records; end <= size {
+            snapshot, err := seg.log.Snapshot()
+            if err != nil {
+                return 0, err
+            }
+            segmentHash = snapshot.Hash()
+        } else if hasher, ok := seg.log.(common.SnapshotHasher); ok {
+            h, err := hasher.SnapshotHash(size - seg.base)
+            if err != nil {
+                return 0, err
+            }
+            segmentHash = h
+        } else {
+            return 0, common.ErrSnapshotUnsupported
+        }
+
+        xbinary.LittleEndian.PutUint64(buffer, 0, segmentHash)
+        hash.Write(buffer)
+    }
+    return hash.Sum64(), nil
+}
+
+// Metadata combines the metadata of all the segments. The file name is the
+// segment directory. Like a single log, the record count includes the records
+// in segments which have been removed.
+func (l *Log) Metadata() (common.Metadata, error) {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    active := l.active()
+    meta := common.Metadata{FileName: l.dir, Records: active.base + active.records}
+    for _, seg := range l.segments {
+        m, err := seg.log.Metadata()
+        if err != nil {
+            return meta, err
+        }
+
+        meta.Size += m.Size
+        meta.LastModifiedTime = m.LastModifiedTime
+    }
+    return meta, nil
+}
+
+// State returns whether the log is open or closed.
+func (l *Log) State() common.State {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+    return l.state
+}
+
+// Segments returns the file names of the segment data files in order.
+func (l *Log) Segments() []string {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    filenames := make([]string, len(l.segments))
+    for i, seg := range l.segments {
+        filenames[i] = seg.filename
+    }
+    return filenames
+}
+
+// Reclaim removes every sealed segment whose records have all expired
+// according to the log's TTL and returns the number of segments removed.
+// The active segment is never removed. Combined with `Policy.MaxAge`, disk
+// usage is bounded by the TTL window.
+//
+// Record indexes are not changed. Cursors positioned in a removed segment
+// continue at the first record of the oldest remaining segment.
+func (l *Log) Reclaim() (int, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.state == common.CLOSED {
+        return 0, common.ErrLogClosed
+    }
+
+    ttl := l.config.TimeToLive
+    if ttl <= 0 {
+        return 0, nil
+    }
+
+    now := time.Now().UnixNano()
+    var removed int
+    for len(l.segments) > 1 {
+        seg := l.segments[0]
+
+        // the last write time of a segment is the time of its newest record
+        meta, err := seg.log.Metadata()
+        if err != nil {
+            return removed, err
+        } else if now <= meta.LastModifiedTime+ttl {
+            break
+        }
+
+        if err := seg.remove(); err != nil {
+            return removed, err
+        }
+        l.segments = l.segments[1:]
+        removed++
+    }
+    return removed, nil
+}
+
+// reclaimer calls Reclaim at the given interval until the done channel is
+// closed.
+func (l *Log) reclaimer(interval time.Duration, done chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            l.Reclaim()
+        case <-done:
+            return
+        }
+    }
+}
+
+// remove closes the segment and deletes its data and index files.
+func (s *segment) remove() error {
+    if err := s.log.Close(); err != nil {
+        return err
+    }
+    if err := os.Remove(s.filename); err != nil {
+        return err
+    }
+    if err := os.Remove(s.filename + ".keys"); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return os.Remove(s.filename + ".idx")
+}
+
+// find returns the segment containing the given record index. Indexes past
+// the end of the log belong to the active segment and indexes before the
+// first segment belong to the first segment.
+func (l *Log) find(index uint64) *segment {
+    i := sort.Search(len(l.segments), func(i int) bool {
+        return l.segments[i].base > index
+    })
+    if i == 0 {
+        return l.segments[0]
+    }
+    return l.segments[i-1]
+}
+
+// uint64Slice sorts record indexes in ascending order.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
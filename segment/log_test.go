@@ -0,0 +1,620 @@
+package segment
+
+import (
+    "bytes"
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/wallaby/v1"
+    "github.com/blacklabeldata/xbinary"
+    "github.com/stretchr/testify/assert"
+)
+
+// createTestDir creates a temporary directory for the test segments.
+func createTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "wallaby-segment")
+    assert.Nil(t, err, "Test dir could not be created")
+    return dir
+}
+
+// writeTestRecords appends `count` 8-byte records to the log. Each record
+// contains its own record index.
+func writeTestRecords(t *testing.T, log common.WriteAheadLog, start, count int) {
+    buffer := make([]byte, 8)
+    for i := start; i < start+count; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+        _, err := log.Write(buffer)
+        assert.Nil(t, err)
+    }
+}
+
+// ingestOld appends `count` 8-byte records written the given duration ago as
+// one stream. Each record contains its own record index.
+func ingestOld(t *testing.T, log common.WriteAheadLog, start, count int, age time.Duration) {
+    var stream bytes.Buffer
+    encoder, err := v1.NewLogRecordEncoder(8, &stream)
+    assert.Nil(t, err)
+
+    written := time.Now().Add(-age).UnixNano()
+    buffer := make([]byte, 8)
+    for i := start; i < start+count; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+        _, err := encoder(uint64(i), 0, written, buffer)
+        assert.Nil(t, err)
+    }
+    n, err := log.Ingest(&stream)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(count), n)
+}
+
+// readAllRecords reads the value of every record in the log.
+func readAllRecords(t *testing.T, log common.WriteAheadLog) []uint64 {
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var values []uint64
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        values = append(values, value)
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    return values
+}
+
+// sequence returns the values 0 through n-1.
+func sequence(n int) []uint64 {
+    values := make([]uint64, n)
+    for i := range values {
+        values[i] = uint64(i)
+    }
+    return values
+}
+
+func TestRollByRecords(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 4})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    writeTestRecords(t, log, 0, 10)
+    assert.Equal(t, []string{
+        filepath.Join(dir, "00000000000000000000.log"),
+        filepath.Join(dir, "00000000000000000004.log"),
+        filepath.Join(dir, "00000000000000000008.log"),
+    }, log.Segments())
+    assert.Equal(t, sequence(10), readAllRecords(t, log))
+
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(10), meta.Records)
+}
+
+func TestRollByBytes(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    // each segment holds the file header and two 24-byte records
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxBytes: common.LogHeaderSize + 2*24})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    writeTestRecords(t, log, 0, 5)
+    assert.Len(t, log.Segments(), 3)
+    assert.Equal(t, sequence(5), readAllRecords(t, log))
+}
+
+func TestRollByAge(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxAge: time.Hour})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    // the segment of the old records is rolled, the new segment is not
+    ingestOld(t, log, 0, 2, 2*time.Hour)
+    writeTestRecords(t, log, 2, 2)
+
+    assert.Len(t, log.Segments(), 2)
+    assert.Equal(t, sequence(4), readAllRecords(t, log))
+}
+
+func TestReopen(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 3})
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 0, 7)
+    assert.Nil(t, log.Close())
+
+    log, err = Open(dir, v1.DefaultConfig, Policy{MaxRecords: 3})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    assert.Len(t, log.Segments(), 3)
+    writeTestRecords(t, log, 7, 3)
+    assert.Len(t, log.Segments(), 4)
+    assert.Equal(t, sequence(10), readAllRecords(t, log))
+}
+
+func TestReopenGap(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 0, 6)
+    assert.Nil(t, log.Close())
+
+    // remove the middle segment
+    assert.Nil(t, os.Remove(filepath.Join(dir, "00000000000000000002.log")))
+    assert.Nil(t, os.Remove(filepath.Join(dir, "00000000000000000002.log.idx")))
+
+    _, err = Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Equal(t, common.ErrSegmentGap, err)
+}
+
+func TestCursorCrossesSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+
+    // the cursor follows records appended to new segments
+    writeTestRecords(t, log, 0, 5)
+    for i := uint64(0); i < 5; i++ {
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        assert.Equal(t, i, value)
+    }
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+
+    // seek into a sealed segment and read across the boundary
+    record, err := cursor.Seek(3)
+    assert.Nil(t, err)
+    value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(3), value)
+
+    record, err = cursor.Next()
+    assert.Nil(t, err)
+    value, _ = xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(4), value)
+}
+
+func TestCursorNextWaitAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    // the cursor is woken by records written to new segments
+    go func() {
+        for i := 0; i < 5; i++ {
+            time.Sleep(time.Millisecond)
+            writeTestRecords(t, log, i, 1)
+        }
+    }()
+    for i := uint64(0); i < 5; i++ {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        record, err := cursor.NextWait(ctx)
+        cancel()
+        assert.Nil(t, err)
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        assert.Equal(t, i, value)
+    }
+}
+
+func TestAppendAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    // record indexes continue across segments
+    for i := uint64(0); i < 5; i++ {
+        index, err := log.AppendWithFlags(uint32(i), make([]byte, 8))
+        assert.Nil(t, err)
+        assert.Equal(t, i, index)
+    }
+    assert.Len(t, log.Segments(), 3)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.Seek(3)
+    assert.Nil(t, err)
+    assert.Equal(t, uint32(3), record.Flags())
+}
+
+func TestTruncateAfterAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 7)
+    assert.Len(t, log.Segments(), 4)
+
+    // the segments after the record are removed
+    assert.Nil(t, log.TruncateAfter(2))
+    assert.Len(t, log.Segments(), 2)
+    assert.Equal(t, sequence(3), readAllRecords(t, log))
+
+    // appends continue at the freed record indexes
+    index, err := log.Append(make([]byte, 8))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), index)
+    assert.Len(t, log.Segments(), 2)
+}
+
+func TestTruncateBeforeRemovesSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 7)
+
+    // only segments before the record are removed
+    assert.Nil(t, log.TruncateBefore(3))
+    assert.Len(t, log.Segments(), 3)
+    assert.Equal(t, []uint64{2, 3, 4, 5, 6}, readAllRecords(t, log))
+
+    // truncating before the end of the log removes every record
+    assert.Equal(t, common.ErrIndexOutOfRange, log.TruncateBefore(100))
+    assert.Nil(t, log.TruncateBefore(7))
+    assert.Len(t, log.Segments(), 1)
+    assert.Len(t, readAllRecords(t, log), 0)
+
+    index, err := log.Append(make([]byte, 8))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(7), index)
+}
+
+func TestClosed(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    assert.Equal(t, common.OPEN, log.State())
+    writeTestRecords(t, log, 0, 3)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    assert.Nil(t, log.Close())
+    assert.Equal(t, common.CLOSED, log.State())
+    assert.Equal(t, common.ErrLogClosed, log.Close())
+
+    _, err = log.Write(make([]byte, 8))
+    assert.Equal(t, common.ErrLogClosed, err)
+    _, err = log.Cursor()
+    assert.Equal(t, common.ErrLogClosed, err)
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrLogClosed, err)
+}
+
+func TestReclaimExpiredSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := v1.DefaultConfig
+    config.TimeToLive = int64(time.Hour)
+    log, err := Open(dir, config, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    ingestOld(t, log, 0, 2, 2*time.Hour)
+    ingestOld(t, log, 2, 2, 2*time.Hour)
+    ingestOld(t, log, 4, 1, 2*time.Hour)
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    writeTestRecords(t, log, 5, 2)
+    assert.Len(t, log.Segments(), 4)
+
+    // the cursor skips expired records across segments
+    record, err := cursor.Next()
+    assert.Nil(t, err)
+    value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(5), value)
+    assert.Equal(t, uint64(6), cursor.Position())
+
+    // the two oldest segments have fully expired, the third segment
+    // contains an unexpired record
+    removed, err := log.Reclaim()
+    assert.Nil(t, err)
+    assert.Equal(t, 2, removed)
+    assert.Equal(t, []string{
+        filepath.Join(dir, "00000000000000000004.log"),
+        filepath.Join(dir, "00000000000000000006.log"),
+    }, log.Segments())
+
+    _, err = os.Stat(filepath.Join(dir, "00000000000000000000.log"))
+    assert.True(t, os.IsNotExist(err))
+
+    // record indexes are unchanged
+    record, err = cursor.Seek(6)
+    assert.Nil(t, err)
+    value, _ = xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(6), value)
+}
+
+func TestBackgroundReclaim(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := v1.DefaultConfig
+    config.TimeToLive = int64(time.Hour)
+    log, err := Open(dir, config, Policy{MaxRecords: 1, ReclaimInterval: 5 * time.Millisecond})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    for i := 0; i < 3; i++ {
+        ingestOld(t, log, i, 1, 2*time.Hour)
+    }
+
+    // wait for the reclaimer to remove the sealed segments
+    deadline := time.Now().Add(5 * time.Second)
+    for len(log.Segments()) > 1 && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+    assert.Len(t, log.Segments(), 1)
+}
+
+func TestPipeIngestAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    source, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer source.Close()
+    writeTestRecords(t, source, 0, 7)
+
+    // pipe records 1 through 5 which span three segments
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(1, 5, &buffer))
+    assert.Equal(t, 5*(v1.LogRecordHeaderSize+8), buffer.Len())
+
+    // records removed with their segment cannot be piped
+    assert.Nil(t, source.TruncateBefore(2))
+    assert.Equal(t, common.ErrIndexOutOfRange, source.Pipe(1, 5, ioutil.Discard))
+
+    target, err := Open(other, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer target.Close()
+
+    count, err := target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(5), count)
+    assert.Equal(t, []uint64{1, 2, 3, 4, 5}, readAllRecords(t, target))
+
+    // the policy applies to the next write
+    writeTestRecords(t, target, 6, 1)
+    assert.Len(t, target.Segments(), 2)
+}
+
+func TestVerifyAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 4})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    // snapshots inside a segment and at the end of a segment
+    writeTestRecords(t, log, 0, 6)
+    partial, err := log.Snapshot()
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 6, 2)
+    full, err := log.Snapshot()
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 8, 3)
+
+    assert.Nil(t, log.Verify(partial))
+    assert.Nil(t, log.Verify(full))
+
+    // removing a segment changes the hash
+    assert.Nil(t, log.TruncateBefore(4))
+    assert.Equal(t, common.ErrSnapshotMismatch, log.Verify(full))
+}
+
+func TestRangeAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 4})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    writeTestRecords(t, log, 0, 6)
+    from := time.Now()
+    writeTestRecords(t, log, 6, 4)
+    to := time.Now()
+    writeTestRecords(t, log, 10, 3)
+
+    cursor, err := log.Range(from, to)
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var values []uint64
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        values = append(values, value)
+    }
+    assert.Equal(t, common.ErrEndOfRange, err)
+    assert.Equal(t, []uint64{6, 7, 8, 9}, values)
+
+    // Prev stops at the start of the range inside a segment
+    values = nil
+    record, err = cursor.Prev()
+    for ; err == nil; record, err = cursor.Prev() {
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        values = append(values, value)
+    }
+    assert.Equal(t, common.ErrStartOfLog, err)
+    assert.Equal(t, []uint64{9, 8, 7, 6}, values)
+    assert.Equal(t, uint64(6), cursor.Position())
+
+    // seek into a later segment
+    cursor, err = log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err = cursor.SeekTime(to)
+    assert.Nil(t, err)
+    value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(10), value)
+}
+
+func TestPrevAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 4})
+    assert.Nil(t, err)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 10)
+
+    cursor, err := log.Cursor(common.FromEnd())
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var values []uint64
+    record, err := cursor.Prev()
+    for ; err == nil; record, err = cursor.Prev() {
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        values = append(values, value)
+    }
+    assert.Equal(t, common.ErrStartOfLog, err)
+    assert.Equal(t, []uint64{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}, values)
+
+    // change direction in the middle of a segment
+    _, err = cursor.Seek(6)
+    assert.Nil(t, err)
+    record, err = cursor.Prev()
+    assert.Nil(t, err)
+    value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(6), value)
+    record, err = cursor.Next()
+    assert.Nil(t, err)
+    value, _ = xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Equal(t, uint64(6), value)
+}
+
+func TestGetLatestAcrossSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 2})
+    assert.Nil(t, err)
+    defer log.Close()
+
+    // "a" is only in the first segment, "b" is in every segment
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"b", "2"}, {"b", "3"}, {"b", "4"}} {
+        _, err := log.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+    assert.Len(t, log.Segments(), 3)
+
+    record, err := log.GetLatest([]byte("a"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("1"), record.Data())
+    record, err = log.GetLatest([]byte("b"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("4"), record.Data())
+    _, err = log.GetLatest([]byte("c"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    // the key index is removed with its segment
+    assert.Nil(t, log.TruncateBefore(2))
+    _, err = log.GetLatest([]byte("a"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, err = os.Stat(filepath.Join(dir, "00000000000000000000.log.keys"))
+    assert.True(t, os.IsNotExist(err))
+}
+
+func TestCompactSealedSegments(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := Open(dir, v1.DefaultConfig, Policy{MaxRecords: 3})
+    assert.Nil(t, err)
+
+    // "a" is replaced in a later segment, "b" in the active segment
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"a", "3"}, {"c", "1"}, {"c", "2"}, {"b", "2"}} {
+        _, err := log.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+    assert.Len(t, log.Segments(), 3)
+    assert.Nil(t, log.Compact())
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+
+    records := make(map[uint64]string)
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        records[cursor.Position()-1] = string(record.Key()) + "=" + string(record.Data())
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    assert.Equal(t, map[uint64]string{3: "a=3", 5: "c=2", 6: "b=2"}, records)
+
+    // the record indexes are kept after reopening
+    assert.Nil(t, cursor.Close())
+    assert.Nil(t, log.Close())
+    log, err = Open(dir, v1.DefaultConfig, Policy{MaxRecords: 3})
+    assert.Nil(t, err)
+    defer log.Close()
+    index, err := log.AppendKeyed([]byte("a"), []byte("4"))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(7), index)
+}
+
+func TestReservedConfigFlags(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := v1.DefaultConfig
+    config.Flags = common.BatchFlag
+    _, err := Open(dir, config, Policy{})
+    assert.Equal(t, common.ErrReservedFlags, err)
+}
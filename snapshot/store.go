@@ -0,0 +1,294 @@
+// Package snapshot persists log snapshots. A snapshot records the position
+// and hash of a log at some point in time, and may carry the state of the
+// application built from the records before that position. On startup the
+// application loads the latest snapshot and replays the log from the
+// snapshot's position.
+package snapshot
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/OneOfOne/xxhash"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+const (
+
+    // version is the version of the snapshot file format
+    version = 1
+
+    // headerSize is the size of the signature, version, snapshot and state
+    // length at the start of a snapshot file
+    headerSize = 4 + 24 + 8
+
+    // checksumSize is the size of the XXH64 checksum at the end of a snapshot
+    // file
+    checksumSize = 8
+
+    // extension is the file extension of snapshot files
+    extension = ".snapshot"
+)
+
+// Stored is a snapshot read from a store along with the application state
+// saved with it.
+type Stored struct {
+
+    // ID orders the snapshots in a store, later snapshots have higher IDs
+    ID uint64
+
+    Snapshot common.Snapshot
+    State    []byte
+}
+
+// Store is a SnapshotStore which keeps each snapshot in its own file in a
+// directory, usually next to the log. Snapshot files are written to a
+// temporary file and renamed, so a crash never leaves a partial snapshot.
+// Only the newest `retain` snapshots are kept.
+type Store struct {
+    mutex  sync.Mutex
+    dir    string
+    retain int
+    ids    []uint64
+}
+
+// Open opens the snapshot store in the given directory, creating the
+// directory if it does not exist. Temporary files left by an interrupted
+// save are removed. If `retain` is 0 or less every snapshot is kept.
+func Open(dir string, retain int) (*Store, error) {
+    if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+        return nil, err
+    }
+
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    store := &Store{dir: dir, retain: retain}
+    for _, info := range infos {
+        name := info.Name()
+        if strings.HasSuffix(name, extension+".tmp") {
+            if err := os.Remove(filepath.Join(dir, name)); err != nil {
+                return nil, err
+            }
+        } else if strings.HasSuffix(name, extension) {
+            id, err := strconv.ParseUint(strings.TrimSuffix(name, extension), 10, 64)
+            if err != nil {
+                continue
+            }
+            store.ids = append(store.ids, id)
+        }
+    }
+
+    sort.Sort(uint64Slice(store.ids))
+    return store, nil
+}
+
+// filename returns the name of the snapshot file with the given ID.
+func (s *Store) filename(id uint64) string {
+    return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, extension))
+}
+
+// ## **Writing Snapshots**
+
+// Save writes a snapshot and the application state to a new snapshot file
+// and returns its ID. Once the file is in place the oldest snapshots past the
+// retention limit are removed.
+func (s *Store) Save(snapshot common.Snapshot, state []byte) (uint64, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    data, err := encode(snapshot, state)
+    if err != nil {
+        return 0, err
+    }
+
+    var id uint64 = 1
+    if len(s.ids) > 0 {
+        id = s.ids[len(s.ids)-1] + 1
+    }
+
+    // write and sync a temporary file, then move it into place
+    filename := s.filename(id)
+    if err := writeFile(filename+".tmp", data); err != nil {
+        os.Remove(filename + ".tmp")
+        return 0, err
+    }
+    if err := os.Rename(filename+".tmp", filename); err != nil {
+        return 0, err
+    }
+    if err := syncDir(s.dir); err != nil {
+        return 0, err
+    }
+    s.ids = append(s.ids, id)
+
+    // remove the oldest snapshots
+    for s.retain > 0 && len(s.ids) > s.retain {
+        if err := os.Remove(s.filename(s.ids[0])); err != nil && !os.IsNotExist(err) {
+            return id, err
+        }
+        s.ids = s.ids[1:]
+    }
+    return id, nil
+}
+
+// Take saves a snapshot of the log's current position along with the
+// application state. The state should reflect every record before that
+// position.
+func (s *Store) Take(log common.WriteAheadLog, state []byte) (uint64, error) {
+    snapshot, err := log.Snapshot()
+    if err != nil {
+        return 0, err
+    }
+    return s.Save(snapshot, state)
+}
+
+// encode creates the contents of a snapshot file.
+//
+// ```
+// 3-byte signature
+// 1-byte version
+// 24-byte snapshot
+// 8-byte state length
+// state
+// 8-byte xxh64 checksum
+// ```
+func encode(snapshot common.Snapshot, state []byte) ([]byte, error) {
+    marshalled, err := snapshot.MarshalBinary()
+    if err != nil {
+        return nil, err
+    }
+
+    buffer := make([]byte, headerSize+len(state)+checksumSize)
+    copy(buffer, common.SnapshotFileSignature)
+    buffer[3] = version
+    copy(buffer[4:], marshalled)
+    xbinary.LittleEndian.PutUint64(buffer, 28, uint64(len(state)))
+    copy(buffer[headerSize:], state)
+
+    hash := xxhash.New64()
+    hash.Write(buffer[:headerSize+len(state)])
+    xbinary.LittleEndian.PutUint64(buffer, headerSize+len(state), hash.Sum64())
+    return buffer, nil
+}
+
+// writeFile creates a file with the given contents and syncs it.
+func writeFile(filename string, data []byte) error {
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+
+    if _, err := file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// syncDir syncs a directory so a renamed file survives a crash.
+func syncDir(dir string) error {
+    file, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    return file.Sync()
+}
+
+// ## **Reading Snapshots**
+
+// List returns the IDs of the stored snapshots, oldest first.
+func (s *Store) List() []uint64 {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return append([]uint64(nil), s.ids...)
+}
+
+// Latest reads the newest snapshot. `ErrNoSnapshot` is returned if the store
+// is empty.
+func (s *Store) Latest() (*Stored, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if len(s.ids) == 0 {
+        return nil, common.ErrNoSnapshot
+    }
+    return s.load(s.ids[len(s.ids)-1])
+}
+
+// Load reads the snapshot with the given ID. `ErrNoSnapshot` is returned if
+// the snapshot is not in the store.
+func (s *Store) Load(id uint64) (*Stored, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    i := sort.Search(len(s.ids), func(i int) bool { return s.ids[i] >= id })
+    if i == len(s.ids) || s.ids[i] != id {
+        return nil, common.ErrNoSnapshot
+    }
+    return s.load(id)
+}
+
+// load reads and verifies a snapshot file.
+func (s *Store) load(id uint64) (*Stored, error) {
+    data, err := ioutil.ReadFile(s.filename(id))
+    if os.IsNotExist(err) {
+        return nil, common.ErrNoSnapshot
+    } else if err != nil {
+        return nil, err
+    }
+
+    // check the header
+    if len(data) < headerSize+checksumSize || !bytes.Equal(data[:3], common.SnapshotFileSignature) || data[3] != version {
+        return nil, common.ErrInvalidSnapshot
+    }
+    length, _ := xbinary.LittleEndian.Uint64(data, 28)
+    if length != uint64(len(data)-headerSize-checksumSize) {
+        return nil, common.ErrInvalidSnapshot
+    }
+
+    // check the contents
+    end := headerSize + int(length)
+    hash := xxhash.New64()
+    hash.Write(data[:end])
+    if checksum, _ := xbinary.LittleEndian.Uint64(data, end); checksum != hash.Sum64() {
+        return nil, common.ErrCorruptSnapshot
+    }
+
+    snapshot, err := common.UnmarshalShapshot(data[4:28])
+    if err != nil {
+        return nil, err
+    }
+    return &Stored{ID: id, Snapshot: snapshot, State: data[headerSize:end]}, nil
+}
+
+// ## **Replaying the Log**
+
+// Cursor creates a cursor on the log starting at the snapshot's position, so
+// the first record read is the first record written after the snapshot was
+// taken.
+func Cursor(log common.WriteAheadLog, snapshot common.Snapshot, options ...common.CursorOption) (common.LogCursor, error) {
+    options = append(options[:len(options):len(options)], common.StartAt(uint64(snapshot.Size())))
+    return log.Cursor(options...)
+}
+
+// uint64Slice sorts snapshot IDs.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,113 @@
+package snapshot
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/wallaby/v1"
+    "github.com/blacklabeldata/xbinary"
+    "github.com/stretchr/testify/assert"
+)
+
+// createTestDir creates a temporary directory for the test log and
+// snapshots.
+func createTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "wallaby-snapshot")
+    assert.Nil(t, err, "Test dir could not be created")
+    return dir
+}
+
+// writeTestRecords appends `count` 8-byte records to the log. Each record
+// contains its own record index.
+func writeTestRecords(t *testing.T, log common.WriteAheadLog, start, count int) {
+    buffer := make([]byte, 8)
+    for i := start; i < start+count; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+        _, err := log.Write(buffer)
+        assert.Nil(t, err)
+    }
+}
+
+func TestSaveAndRetain(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    store, err := Open(dir, 2)
+    assert.Nil(t, err)
+    _, err = store.Latest()
+    assert.Equal(t, common.ErrNoSnapshot, err)
+
+    for i := 1; i <= 3; i++ {
+        id, err := store.Save(common.NewSnapshot(int64(i), int64(i*10), uint64(i)), []byte{byte(i)})
+        assert.Nil(t, err)
+        assert.Equal(t, uint64(i), id)
+    }
+
+    // only the last two are kept
+    assert.Equal(t, []uint64{2, 3}, store.List())
+    _, err = store.Load(1)
+    assert.Equal(t, common.ErrNoSnapshot, err)
+
+    // the latest is found after reopening, leftover temporary files are removed
+    assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000004.snapshot.tmp"), []byte("partial"), 0600))
+    store, err = Open(dir, 2)
+    assert.Nil(t, err)
+    assert.Equal(t, []uint64{2, 3}, store.List())
+    _, err = os.Stat(filepath.Join(dir, "00000000000000000004.snapshot.tmp"))
+    assert.True(t, os.IsNotExist(err))
+
+    latest, err := store.Latest()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), latest.ID)
+    assert.Equal(t, common.NewSnapshot(3, 30, 3), latest.Snapshot)
+    assert.Equal(t, []byte{3}, latest.State)
+
+    // a damaged file is detected
+    filename := filepath.Join(dir, "00000000000000000003.snapshot")
+    data, err := ioutil.ReadFile(filename)
+    assert.Nil(t, err)
+    data[len(data)-9] ^= 0xff
+    assert.Nil(t, ioutil.WriteFile(filename, data, 0600))
+    _, err = store.Latest()
+    assert.Equal(t, common.ErrCorruptSnapshot, err)
+}
+
+func TestCursorFromSnapshot(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log, err := wallaby.Create(filepath.Join(dir, "test.log"), v1.DefaultConfig)
+    assert.Nil(t, err)
+    defer log.Close()
+
+    store, err := Open(filepath.Join(dir, "snapshots"), 0)
+    assert.Nil(t, err)
+
+    writeTestRecords(t, log, 0, 5)
+    _, err = store.Take(log, []byte("state"))
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 5, 3)
+
+    latest, err := store.Latest()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(5), latest.Snapshot.Size())
+    assert.Equal(t, []byte("state"), latest.State)
+
+    // replay the records after the snapshot
+    cursor, err := Cursor(log, latest.Snapshot)
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var values []uint64
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        value, _ := xbinary.LittleEndian.Uint64(record.Data(), 0)
+        values = append(values, value)
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    assert.Equal(t, []uint64{5, 6, 7}, values)
+}
@@ -0,0 +1,150 @@
+package v1
+
+import (
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+)
+
+// commitRequest is a record, or an atomic batch of records, waiting to be
+// written by the committer. Raw requests hold records ingested from another
+// log which keep their own flags and timestamps.
+type commitRequest struct {
+    flags   uint32
+    records [][]byte
+    raw     bool
+    index   uint64
+    n       int
+    err     error
+    synced  chan struct{}
+}
+
+// groupCommit queues the request for the committer and waits until the batch
+// containing it has been synced.
+func (w *wal) groupCommit(request *commitRequest) (uint64, int, error) {
+    request.synced = make(chan struct{})
+
+    select {
+    case w.commits <- request:
+    case <-w.done:
+        return 0, 0, common.ErrLogClosed
+    }
+
+    <-request.synced
+    return request.index, request.n, request.err
+}
+
+// committer collects queued records into batches and commits them until the
+// done channel is closed. A batch is committed once it holds
+// `policy.MaxRecords` records or the first record has waited
+// `policy.MaxWait`.
+func (w *wal) committer(policy common.GroupCommitPolicy, commits chan *commitRequest, done chan struct{}) {
+    defer w.wait.Done()
+
+    batch := make([]*commitRequest, 0, policy.MaxRecords)
+    for {
+        var records int
+
+        // wait for the first record
+        select {
+        case request := <-commits:
+            batch = append(batch, request)
+            records += len(request.records)
+        case <-done:
+            return
+        }
+
+        // collect more records until the batch is full or the wait is over
+        var timer *time.Timer
+        var timeout <-chan time.Time
+        if policy.MaxWait > 0 {
+            timer = time.NewTimer(policy.MaxWait)
+            timeout = timer.C
+        }
+
+    collect:
+        for records < policy.MaxRecords {
+            if timeout == nil {
+                select {
+                case request := <-commits:
+                    batch = append(batch, request)
+                    records += len(request.records)
+                default:
+                    break collect
+                }
+            } else {
+                select {
+                case request := <-commits:
+                    batch = append(batch, request)
+                    records += len(request.records)
+                case <-timeout:
+                    break collect
+                }
+            }
+        }
+
+        if timer != nil {
+            timer.Stop()
+        }
+
+        w.commit(batch)
+        batch = batch[:0]
+    }
+}
+
+// commit writes a batch of records to the data and index files, syncs both
+// files once and releases the writers. If the batch cannot be written or
+// synced every writer in it gets the error.
+func (w *wal) commit(batch []*commitRequest) {
+    w.mutex.Lock()
+
+    // encode each request, requests which fail to encode are left out
+    for _, request := range batch {
+        if request.raw {
+            request.err = w.appendRaw(request.records)
+        } else {
+            request.index, request.n, request.err = w.appendBatch(request.flags, time.Now().UnixNano(), request.records)
+        }
+    }
+
+    // write and sync the batch
+    err := w.flush()
+    if err == nil {
+        err = w.sync()
+    }
+    w.mutex.Unlock()
+
+    // release the writers
+    for _, request := range batch {
+        if request.err == nil && err != nil {
+            request.index, request.n, request.err = 0, 0, err
+        }
+        close(request.synced)
+    }
+}
+
+// Sync flushes the data and index files to permanent storage. Records
+// written before Sync is called are durable once it returns, whatever the
+// write strategy is.
+func (w *wal) Sync() error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    }
+    return w.sync()
+}
+
+// sync flushes the data and index files to permanent storage.
+func (w *wal) sync() error {
+    if err := w.file.Sync(); err != nil {
+        return err
+    }
+    if w.keys != nil {
+        if err := w.keys.Sync(); err != nil {
+            return err
+        }
+    }
+    return w.index.Sync()
+}
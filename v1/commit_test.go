@@ -0,0 +1,112 @@
+package v1
+
+import (
+    "bytes"
+    "os"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestGroupCommit(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.GroupCommit = common.GroupCommitPolicy{MaxRecords: 16, MaxWait: time.Millisecond}
+    log := openTestLog(t, dir, config)
+
+    // append records from many goroutines
+    var group sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        group.Add(1)
+        go func() {
+            defer group.Done()
+            for j := 0; j < 25; j++ {
+                n, err := log.Write(make([]byte, 32))
+                assert.Nil(t, err)
+                assert.Equal(t, 32+LogRecordHeaderSize, n)
+            }
+        }()
+    }
+    group.Wait()
+
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(200), meta.Records)
+    assert.Equal(t, int64(LogHeaderSize+200*(LogRecordHeaderSize+32)), meta.Size)
+
+    // records which are too large fail without failing the batch
+    _, err = log.Write(make([]byte, 128*1024))
+    assert.Equal(t, common.ErrRecordTooLarge, err)
+
+    // writes fail once the log is closed
+    assert.Nil(t, log.Close())
+    _, err = log.Write(make([]byte, 32))
+    assert.Equal(t, common.ErrLogClosed, err)
+
+    // every record is in the log after reopening it
+    log = openTestLog(t, dir, config)
+    defer log.Close()
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var last int64
+    for i := 0; i < 200; i++ {
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        assert.True(t, record.Time() >= last)
+        last = record.Time()
+    }
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+}
+
+func TestGroupCommitIngest(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    source := openTestLog(t, dir, DefaultConfig)
+    defer source.Close()
+    writeTestRecords(t, source, 0, 10)
+    _, err := source.WriteBatch([][]byte{[]byte("a"), []byte("b")})
+    assert.Nil(t, err)
+
+    config := DefaultConfig
+    config.GroupCommit = common.GroupCommitPolicy{MaxRecords: 16, MaxWait: time.Millisecond}
+    target := openTestLog(t, other, config)
+
+    // ingested records are committed along with concurrent writes
+    var group sync.WaitGroup
+    group.Add(1)
+    go func() {
+        defer group.Done()
+        for j := 0; j < 20; j++ {
+            _, err := target.Write(make([]byte, 32))
+            assert.Nil(t, err)
+        }
+    }()
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(0, 12, &buffer))
+    count, err := target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(12), count)
+    group.Wait()
+
+    meta, err := target.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(32), meta.Records)
+
+    // ingesting fails once the log is closed
+    assert.Nil(t, target.Close())
+    assert.Nil(t, source.Pipe(0, 1, &buffer))
+    _, err = target.Ingest(&buffer)
+    assert.Equal(t, common.ErrLogClosed, err)
+}
@@ -0,0 +1,202 @@
+package v1
+
+import (
+    "io"
+    "os"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// Compact removes every keyed record which is not the newest record with its
+// key. The newest record with a key is removed too if it is a tombstone, a
+// keyed record without data, which was written longer ago than the tombstone
+// retention. Unkeyed records are kept.
+//
+// The log is locked while it is compacted, so every record in it is sealed
+// and compacted. See CompactKeys for how the files are rewritten.
+func (w *wal) Compact() error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    } else if w.recoveryRequired {
+        return common.ErrRecoveryRequired
+    } else if !w.reserved {
+        return common.ErrReservedFlagsUnsupported
+    }
+
+    latest, err := common.LatestKeys(w)
+    if err != nil {
+        return err
+    }
+    return w.compact(common.NewestKey(latest, 0))
+}
+
+// CompactKeys removes the keyed records which `newest` reports are not the
+// newest record with their key, and tombstones past the tombstone retention.
+//
+// The kept records are copied unchanged into new data and index files which
+// replace the old ones, like `TruncateBefore` does. Each removed record is
+// replaced by an empty record with the `CompactedFlag` and the original
+// timestamp, so every record keeps its record index and recovery can still
+// rebuild the index from the data file. Cursors skip the empty records. The
+// running hash is recomputed, so snapshots taken before compaction no longer
+// match.
+func (w *wal) CompactKeys(newest func(key []byte, index uint64) bool) error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    } else if w.recoveryRequired {
+        return common.ErrRecoveryRequired
+    } else if !w.reserved {
+        return common.ErrReservedFlagsUnsupported
+    }
+    return w.compact(newest)
+}
+
+// compact rewrites the log without the records rejected by keep. The mutex
+// must be held.
+func (w *wal) compact(newest func(key []byte, index uint64) bool) error {
+    base, size := w.index.Base(), w.index.Size()
+    if size == base {
+        return nil
+    }
+    headerSize := int64(common.LogHeaderSize + 8)
+    expired := time.Now().Add(-w.retention).UnixNano()
+
+    // copy the kept records into a new data file
+    header, err := common.ReadFileHeader(io.NewSectionReader(w.file, 0, common.LogHeaderSize))
+    if err != nil {
+        return err
+    }
+    offset := headerSize
+    records := make([]common.IndexRecord, 0, size-base)
+    var removed int
+    err = w.rewrite(w.filename, common.LogFileSignature, header, base, func(writer io.Writer) error {
+        encoder, err := w.format.NewEncoder(maxStoredSize(w.maxRecordSize), writer)
+        if err != nil {
+            return err
+        }
+
+        for i := base; i < size; i++ {
+            indexRecord, err := w.index.Get(i)
+            if err != nil {
+                return err
+            }
+            buffer, err := w.readRecord(indexRecord.Offset())
+            if err != nil {
+                return err
+            }
+            kept, err := w.keep(i, buffer, newest, expired)
+            if err != nil {
+                return err
+            }
+
+            // removed records leave an empty record without their key
+            var n int
+            if kept {
+                n, err = writer.Write(buffer)
+            } else {
+                flags, _ := xbinary.LittleEndian.Uint32(buffer, 4)
+                flags = flags&^(common.CompressionFlag|common.EncryptionFlag|common.KeyedFlag) | common.CompactedFlag
+                n, err = encoder(i, flags, indexRecord.Time(), nil)
+                removed++
+            }
+            if err != nil {
+                return err
+            }
+
+            records = append(records, common.NewIndexRecord(indexRecord.Time(), offset, i))
+            offset += int64(n)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // keep the old files if nothing was removed
+    if removed == 0 {
+        return os.Remove(w.filename + ".tmp")
+    }
+
+    // write the index records of the new data file
+    err = w.rewrite(w.filename+".idx", common.IndexFileSignature, w.index.Header(), base, func(writer io.Writer) error {
+        encoder := NewIndexRecordEncoder(writer)
+        for _, record := range records {
+            if _, err := encoder(record); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        os.Remove(w.filename + ".tmp")
+        return err
+    }
+
+    if err := w.replaceFiles(); err != nil {
+        return err
+    }
+
+    // update the log state to match the new files
+    w.headerSize = headerSize
+    w.logSize = offset
+    if err := w.rehash(); err != nil {
+        return err
+    }
+
+    // the key index may refer to removed tombstones
+    return w.rebuildKeys()
+}
+
+// keep reports whether compaction keeps the record at the given record
+// index. Tombstones written before `expired` are removed even when they are
+// the newest record with their key.
+func (w *wal) keep(index uint64, buffer []byte, newest func(key []byte, index uint64) bool, expired int64) (bool, error) {
+    flags, _ := xbinary.LittleEndian.Uint32(buffer, 4)
+    if flags&common.KeyedFlag == 0 {
+        return true, nil
+    }
+
+    record, err := w.format.Decode(index, buffer)
+    if err != nil {
+        return false, err
+    }
+    record, err = decodeRecord(record, buffer, w.maxRecordSize, w.compressor, w.keyProvider)
+    if err != nil {
+        return false, err
+    }
+
+    if !newest(record.Key(), index) {
+        return false, nil
+    }
+    return record.Size() > 0 || record.Time() >= expired, nil
+}
+
+// readRecord reads the header and data of the record at the given offset in
+// the data file.
+func (w *wal) readRecord(offset int64) ([]byte, error) {
+    headerSize := w.format.HeaderSize
+
+    header := make([]byte, headerSize)
+    if n, _ := w.file.ReadAt(header, offset); n < headerSize {
+        return nil, common.ErrReadLogRecord
+    }
+    size, _ := xbinary.LittleEndian.Uint32(header, 0)
+    if uint64(size) > uint64(maxStoredSize(w.maxRecordSize)) {
+        return nil, common.ErrInvalidRecordSize
+    }
+
+    buffer := make([]byte, headerSize+int(size))
+    copy(buffer, header)
+    if n, _ := w.file.ReadAt(buffer[headerSize:], offset+int64(headerSize)); n < int(size) {
+        return nil, common.ErrReadLogRecord
+    }
+    return buffer, nil
+}
@@ -0,0 +1,144 @@
+package v1
+
+import (
+    "compress/flate"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// readPositions reads every record of the log and returns the record index
+// and data of each one.
+func readPositions(t *testing.T, log common.WriteAheadLog) map[uint64]string {
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    records := make(map[uint64]string)
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        records[cursor.Position()-1] = string(record.Data())
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    return records
+}
+
+func TestCompact(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.Compressor = common.NewFlateCompressor(flate.BestSpeed)
+    log := openTestLog(t, dir, config)
+
+    _, err := log.Write([]byte("unkeyed"))
+    assert.Nil(t, err)
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}, {"c", ""}, {"b", "2"}} {
+        _, err := log.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+    before, err := log.Metadata()
+    assert.Nil(t, err)
+
+    // the newest record of each key and the recent tombstone are kept
+    assert.Nil(t, log.Compact())
+    expected := map[uint64]string{0: "unkeyed", 3: "2", 5: "", 6: "2"}
+    assert.Equal(t, expected, readPositions(t, log))
+
+    after, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, before.Records, after.Records)
+    assert.True(t, after.Size < before.Size)
+
+    // seeking to a removed record moves to the next record
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    record, err := cursor.Seek(1)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("a"), record.Key())
+    assert.Equal(t, uint64(4), cursor.Position())
+    assert.Nil(t, cursor.Close())
+
+    // compacting again changes nothing
+    assert.Nil(t, log.Compact())
+    assert.Equal(t, expected, readPositions(t, log))
+    assert.Nil(t, log.Close())
+
+    // the record indexes are rebuilt from the data file
+    assert.Nil(t, os.Remove(filepath.Join(dir, "test.log.idx")))
+    config.TombstoneRetention = 0
+    log = openTestLog(t, dir, config)
+    defer log.Close()
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(7), report.RecordsRebuilt)
+    assert.Equal(t, expected, readPositions(t, log))
+
+    // expired tombstones are removed
+    assert.Nil(t, log.Compact())
+    delete(expected, 5)
+    assert.Equal(t, expected, readPositions(t, log))
+    _, err = log.GetLatest([]byte("c"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    index, err := log.AppendKeyed([]byte("c"), []byte("2"))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(7), index)
+    record, err = log.GetLatest([]byte("c"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("2"), record.Data())
+}
+
+func TestInterruptedSwap(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    data, err := ioutil.ReadFile(filename)
+    assert.Nil(t, err)
+    index, err := ioutil.ReadFile(filename + ".idx")
+    assert.Nil(t, err)
+    assert.Nil(t, log.TruncateBefore(2))
+    assert.Nil(t, log.Close())
+
+    // leftover new files without the swap marker are removed
+    assert.Nil(t, ioutil.WriteFile(filename+".tmp", []byte("partial"), 0600))
+    assert.Nil(t, ioutil.WriteFile(filename+".idx.tmp", []byte("partial"), 0600))
+    log = openTestLog(t, dir, DefaultConfig)
+    assert.Len(t, readAllRecords(t, log), 3)
+    assert.Nil(t, log.Close())
+    _, err = os.Stat(filename + ".tmp")
+    assert.True(t, os.IsNotExist(err))
+    _, err = os.Stat(filename + ".idx.tmp")
+    assert.True(t, os.IsNotExist(err))
+
+    // a crash after the swap marker was written: the new files are moved
+    // over the old files when the log is opened
+    for _, renamed := range []bool{false, true} {
+        assert.Nil(t, os.Rename(filename+".idx", filename+".idx.tmp"))
+        assert.Nil(t, ioutil.WriteFile(filename+".idx", index, 0600))
+        if !renamed {
+            assert.Nil(t, os.Rename(filename, filename+".tmp"))
+            assert.Nil(t, ioutil.WriteFile(filename, data, 0600))
+        }
+        assert.Nil(t, writeSwapMarker(filename))
+
+        log = openTestLog(t, dir, DefaultConfig)
+        _, err = log.Write(make([]byte, 8))
+        assert.Nil(t, err)
+        records := readAllRecords(t, log)
+        assert.Len(t, records, 4)
+        assert.Equal(t, uint64(2), recordValue(t, records[0]))
+        assert.Nil(t, log.TruncateAfter(4))
+        assert.Nil(t, log.Close())
+
+        _, err = os.Stat(filename + ".swap")
+        assert.True(t, os.IsNotExist(err))
+    }
+}
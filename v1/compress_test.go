@@ -0,0 +1,80 @@
+package v1
+
+import (
+    "bytes"
+    "compress/flate"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestLogCompression(t *testing.T) {
+    for _, compressor := range []common.Compressor{
+        common.NewFlateCompressor(flate.BestSpeed),
+        common.NewGzipCompressor(flate.DefaultCompression),
+    } {
+        dir := createTestDir(t)
+        defer os.RemoveAll(dir)
+
+        config := DefaultConfig
+        config.Compressor = compressor
+        log := openTestLog(t, dir, config)
+
+        // repetitive data is compressed, short data is stored as is
+        large := bytes.Repeat([]byte(`{"event":"login","user":"wallaby"}`), 100)
+        small := []byte("tiny")
+        _, err := log.Write(large)
+        assert.Nil(t, err)
+        _, err = log.AppendWithFlags(0x1, small)
+        assert.Nil(t, err)
+
+        // the max record size applies before compression
+        _, err = log.Write(make([]byte, 128*1024))
+        assert.Equal(t, common.ErrRecordTooLarge, err)
+
+        cursor, err := log.Cursor()
+        assert.Nil(t, err)
+
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, large, record.Data())
+        assert.Equal(t, uint32(len(large)), record.Size())
+        assert.True(t, record.StoredSize() < record.Size())
+        assert.Equal(t, common.CompressionFlag, record.Flags()&common.CompressionFlag)
+
+        record, err = cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, small, record.Data())
+        assert.Equal(t, record.Size(), record.StoredSize())
+        assert.Equal(t, uint32(0x1), record.Flags())
+        assert.Nil(t, cursor.Close())
+        assert.Nil(t, log.Close())
+
+        // cursors without the log need the compressor
+        filename := filepath.Join(dir, "test.log")
+        cursor, err = NewCursor(filename, config.MaxRecordSize)
+        assert.Nil(t, err)
+        _, err = cursor.Next()
+        assert.Equal(t, common.ErrCompressorRequired, err)
+        assert.Nil(t, cursor.Close())
+
+        cursor, err = NewCursor(filename, config.MaxRecordSize, common.WithCompressor(compressor))
+        assert.Nil(t, err)
+        record, err = cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, large, record.Data())
+        assert.Nil(t, cursor.Close())
+
+        // data which decompresses past the limit is rejected
+        compressed, err := compressor.Compress(make([]byte, 1<<20))
+        assert.Nil(t, err)
+        _, err = compressor.Decompress(compressed, 1<<16)
+        assert.Equal(t, common.ErrDecompressedSize, err)
+        data, err := compressor.Decompress(compressed, 1<<20)
+        assert.Nil(t, err)
+        assert.Len(t, data, 1<<20)
+    }
+}
@@ -1,5 +1,7 @@
 package v1
 
+import "time"
+
 // ## **Log Constants**
 
 const (
@@ -13,6 +15,10 @@ const (
     // IndexRecordSize is the size of the index records.
     IndexRecordSize = 24
 
+    // IndexMapRecords is the number of index records covered by the initial
+    // memory map of the index file.
+    IndexMapRecords = 4096
+
     // LogHeaderSize is the header size of version 1 log files
     LogHeaderSize = 16
 
@@ -21,4 +27,9 @@ const (
 
     // MaxRecordSize is the maximum size a record can be for version 1
     MaxRecordSize = 0xffffffff
+
+    // CursorPollInterval is how often a cursor created by `NewCursor` checks
+    // the index file for new records while waiting in NextWait. Cursors
+    // created by an open log are woken by the log instead.
+    CursorPollInterval = 10 * time.Millisecond
 )
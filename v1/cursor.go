@@ -0,0 +1,536 @@
+package v1
+
+import (
+    "context"
+    "io"
+    "os"
+    "sync/atomic"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// NewCursor opens read-only handles to the data file and the index file of
+// the v1 log with the given filename. The cursor starts at record 0. Because
+// the cursor owns its own file handles it can be used while the log is still
+// being appended to.
+//
+// The TTL is read from the index file header. Unless the `WithExpired`
+// option is given, expired records are skipped.
+func NewCursor(filename string, maxSize int, options ...common.CursorOption) (common.LogCursor, error) {
+    return newCursor(filename, maxSize, VersionOneFormat, options)
+}
+
+// newCursor opens a cursor which decodes records with the given format.
+func newCursor(filename string, maxSize int, format RecordFormat, options []common.CursorOption) (common.LogCursor, error) {
+
+    // open data file, return error on fail
+    data, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    // open index file, close data file and return on error
+    index, err := os.Open(filename + ".idx")
+    if err != nil {
+        data.Close()
+        return nil, err
+    }
+
+    // read the ttl and the first record index from the index header
+    header, err := common.ReadFileHeader(index)
+    if err != nil {
+        data.Close()
+        index.Close()
+        return nil, err
+    }
+    base, headerSize, err := readBaseIndex(index, header)
+    if err != nil {
+        data.Close()
+        index.Close()
+        return nil, err
+    }
+
+    c := &cursor{
+        data:     data,
+        index:    &fileIndexReader{index, make([]byte, IndexRecordSize), base, headerSize},
+        maxSize:  maxSize,
+        format:   format,
+        ttl:      header.Expiration(),
+        reserved: header.Version()&common.ReservedFlagsFeature != 0,
+        options:  common.NewCursorOptions(options...),
+    }
+    c.position = c.start()
+    return c, nil
+}
+
+// indexReader finds the index records used by a cursor to locate records in
+// the data file. `ErrEndOfLog` is returned for records which have not been
+// written.
+type indexReader interface {
+    indexRange
+
+    // Wait returns a channel which is closed when new records may have been
+    // written.
+    Wait() <-chan struct{}
+    Close() error
+}
+
+// indexRange gets the index records of the records between the first record
+// and the last written record.
+type indexRange interface {
+    Get(position uint64) (common.IndexRecord, error)
+
+    // Base returns the record index of the first record.
+    Base() uint64
+
+    // Size returns the record index after the last written record.
+    Size() uint64
+}
+
+// fileIndexReader reads index records from an index file handle. Partial
+// index records are treated as not being written yet.
+type fileIndexReader struct {
+    file       *os.File
+    buffer     []byte
+    base       uint64
+    headerSize int64
+}
+
+// Get reads the index record for the given record index.
+func (r *fileIndexReader) Get(position uint64) (common.IndexRecord, error) {
+    offset := r.headerSize + int64(position-r.base)*IndexRecordSize
+
+    n, err := r.file.ReadAt(r.buffer, offset)
+    if n < IndexRecordSize {
+        if err == nil || err == io.EOF {
+            return nil, common.ErrEndOfLog
+        }
+        return nil, common.ErrReadIndexRecord
+    }
+    return RawIndexRecord{r.buffer, 0}, nil
+}
+
+// Base returns the record index of the first record in the index file.
+func (r *fileIndexReader) Base() uint64 {
+    return r.base
+}
+
+// Size returns the record index after the last complete index record in the
+// index file.
+func (r *fileIndexReader) Size() uint64 {
+    stat, err := r.file.Stat()
+    if err != nil || stat.Size() < r.headerSize {
+        return r.base
+    }
+    return r.base + uint64((stat.Size()-r.headerSize)/IndexRecordSize)
+}
+
+// Wait polls the index file, it returns a channel which is closed after
+// `CursorPollInterval`.
+func (r *fileIndexReader) Wait() <-chan struct{} {
+    channel := make(chan struct{})
+    time.AfterFunc(CursorPollInterval, func() {
+        close(channel)
+    })
+    return channel
+}
+
+// Close closes the index file handle.
+func (r *fileIndexReader) Close() error {
+    return r.file.Close()
+}
+
+// walIndexReader reads the published index records of an open log.
+type walIndexReader struct {
+    log *wal
+}
+
+// Get returns the index record for the given record index.
+func (r walIndexReader) Get(position uint64) (common.IndexRecord, error) {
+    return r.log.published(position)
+}
+
+// Base returns the record index of the first record in the log.
+func (r walIndexReader) Base() uint64 {
+    return r.log.index.Base()
+}
+
+// Size returns the record index after the last published record.
+func (r walIndexReader) Size() uint64 {
+    return atomic.LoadUint64(&r.log.tail)
+}
+
+// Wait returns a channel which is closed when the log publishes records or
+// is closed.
+func (r walIndexReader) Wait() <-chan struct{} {
+    return r.log.notifier.Wait()
+}
+
+// Close does nothing, the index belongs to the log.
+func (r walIndexReader) Close() error {
+    return nil
+}
+
+// cursor implements the LogCursor interface for v1 logs. The index is used to
+// locate each record in the data file.
+//
+// Cursors created by an open log reopen their data file handle when the log
+// replaces its files.
+type cursor struct {
+    log        *wal
+    generation uint64
+    data       *os.File
+    index      indexReader
+    maxSize    int
+    format     RecordFormat
+    ttl        int64
+    reserved   bool
+    options    common.CursorOptions
+    position   uint64
+}
+
+// start returns the initial position of the cursor given by its options.
+func (c *cursor) start() uint64 {
+    if c.options.FromEnd {
+        return c.index.Size()
+    }
+    return c.options.Start
+}
+
+// Seek moves the cursor to the given record index and returns the record. If
+// the record has expired the first unexpired record after it is returned.
+func (c *cursor) Seek(offset uint64) (common.LogRecord, error) {
+    c.position = offset
+    return c.Next()
+}
+
+// SeekTime moves the cursor to the first record written at or after the
+// given time and returns the record.
+func (c *cursor) SeekTime(t time.Time) (common.LogRecord, error) {
+    position, err := searchTime(c.index, t.UnixNano())
+    if err != nil {
+        return nil, err
+    }
+
+    c.position = position
+    return c.Next()
+}
+
+// searchTime binary searches the index for the first record written at or
+// after the given time. The record index after the last record is returned if
+// every record is older.
+func searchTime(index indexRange, nanos int64) (uint64, error) {
+    low, high := index.Base(), index.Size()
+    for low < high {
+        middle := low + (high-low)/2
+
+        record, err := index.Get(middle)
+        if err == common.ErrEndOfLog {
+
+            // records removed since the size was read
+            high = middle
+            continue
+        } else if err != nil {
+            return 0, err
+        }
+
+        if record.Time() < nanos {
+            low = middle + 1
+        } else {
+            high = middle
+        }
+    }
+    return low, nil
+}
+
+// Next reads the record at the current position and moves the cursor forward
+// one record. Expired records and records rejected by the cursor's filters
+// are skipped. If the record has not been written yet `ErrEndOfLog` is
+// returned and the cursor does not move.
+func (c *cursor) Next() (common.LogRecord, error) {
+    if c.log != nil {
+        c.log.files.RLock()
+        defer c.log.files.RUnlock()
+
+        if err := c.reopen(); err != nil {
+            return nil, err
+        }
+    }
+
+    // move past records which have been removed
+    if base := c.index.Base(); c.position < base {
+        c.position = base
+    }
+
+    for {
+
+        // find the record in the index, skipping expired records
+        indexRecord, err := c.index.Get(c.position)
+        if err != nil {
+            return nil, err
+        } else if !c.options.IncludeExpired && indexRecord.IsExpired(time.Now().UnixNano(), c.ttl) {
+            c.position++
+            continue
+        }
+
+        // stop at the end of the time range
+        if until := c.options.Until; !until.IsZero() && indexRecord.Time() >= until.UnixNano() {
+            return nil, common.ErrEndOfRange
+        }
+
+        // read the record from the data file, skipping filtered records
+        record, err := c.readLogRecord(indexRecord.Offset())
+        if err != nil {
+            return nil, err
+        }
+
+        c.position++
+        if record != nil {
+            return record, nil
+        }
+    }
+}
+
+// Prev moves the cursor back one record and returns the record before the
+// current position. The following call to Next returns the same record.
+// Expired and filtered records are skipped, as are records written after the
+// end of the time range. `ErrStartOfLog` is returned once the cursor reaches
+// the first record or the start of the time range.
+func (c *cursor) Prev() (common.LogRecord, error) {
+    if c.log != nil {
+        c.log.files.RLock()
+        defer c.log.files.RUnlock()
+
+        if err := c.reopen(); err != nil {
+            return nil, err
+        }
+    }
+
+    // move before records which have been removed from the end
+    if size := c.index.Size(); c.position > size {
+        c.position = size
+    }
+
+    for base := c.index.Base(); c.position > base; {
+        indexRecord, err := c.index.Get(c.position - 1)
+        if err != nil {
+            return nil, err
+        }
+
+        // stop at the start of the time range
+        if since := c.options.Since; !since.IsZero() && indexRecord.Time() < since.UnixNano() {
+            return nil, common.ErrStartOfLog
+        }
+
+        // records are decoded with the cursor position as their index
+        c.position--
+        if !c.options.IncludeExpired && indexRecord.IsExpired(time.Now().UnixNano(), c.ttl) {
+            continue
+        } else if until := c.options.Until; !until.IsZero() && indexRecord.Time() >= until.UnixNano() {
+            continue
+        }
+
+        record, err := c.readLogRecord(indexRecord.Offset())
+        if err != nil {
+            c.position++
+            return nil, err
+        } else if record != nil {
+            return record, nil
+        }
+    }
+    return nil, common.ErrStartOfLog
+}
+
+// reopen reopens the data file if the log replaced it. The caller holds the
+// log's file lock.
+func (c *cursor) reopen() error {
+    if c.generation == c.log.generation {
+        return nil
+    }
+
+    data, err := os.Open(c.log.filename)
+    if err != nil {
+        return err
+    }
+    c.data.Close()
+    c.data = data
+    c.generation = c.log.generation
+    return nil
+}
+
+// NextWait reads the record at the current position like Next. If the
+// record has not been written yet it waits for the log to append it or for
+// the context to be cancelled.
+func (c *cursor) NextWait(ctx context.Context) (common.LogRecord, error) {
+    for {
+
+        // wait on the signal from before the read so an append between the
+        // read and the wait is not missed
+        wait := c.index.Wait()
+        record, err := c.Next()
+        if err != common.ErrEndOfLog {
+            return record, err
+        }
+
+        select {
+        case <-wait:
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Position returns the index of the record read by the next call to Next.
+func (c *cursor) Position() uint64 {
+    return c.position
+}
+
+// readLogRecord reads the record header and data at the given offset in the
+// data file. Each record gets its own buffer so records remain valid after
+// the cursor moves. A nil record is returned if the cursor's filters reject
+// it; the flags are checked before the record data is read.
+func (c *cursor) readLogRecord(offset int64) (common.LogRecord, error) {
+    headerSize := c.format.HeaderSize
+
+    // read record header
+    header := make([]byte, headerSize)
+    n, err := c.data.ReadAt(header, offset)
+    if n < headerSize {
+        return nil, common.ErrReadLogRecord
+    }
+
+    // read record size and validate it
+    size, err := xbinary.LittleEndian.Uint32(header, 0)
+    if err != nil {
+        return nil, common.ErrReadLogRecord
+    } else if uint64(size) > uint64(maxStoredSize(c.maxSize)) {
+        return nil, common.ErrInvalidRecordSize
+    }
+
+    // skip records removed by compaction and records without the requested
+    // flags
+    flags, _ := xbinary.LittleEndian.Uint32(header, 4)
+    if c.reserved && flags&common.CompactedFlag != 0 {
+        return nil, nil
+    } else if mask := c.options.FlagMask; mask != 0 && flags&mask != c.options.FlagValue {
+        return nil, nil
+    }
+
+    // read record data
+    buffer := make([]byte, headerSize+int(size))
+    copy(buffer, header)
+    n, err = c.data.ReadAt(buffer[headerSize:], offset+int64(headerSize))
+    if n < int(size) {
+        return nil, common.ErrReadLogRecord
+    }
+
+    record, err := c.format.Decode(c.position, buffer)
+    if err != nil {
+        return nil, err
+    }
+
+    // the filter sees the decrypted and decompressed data
+    if c.reserved {
+        record, err = decodeRecord(record, buffer, c.maxSize, c.options.Compressor, c.options.KeyProvider)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if filter := c.options.Filter; filter != nil && !filter(record) {
+        return nil, nil
+    }
+    return record, nil
+}
+
+// decodeRecord decrypts and decompresses the data of a record and splits off
+// its key. The buffer holds the record as it was read from the data file, its
+// header is authenticated with encrypted data. Records without encrypted,
+// compressed or keyed data are returned as they are. Data which decompresses
+// to more than `maxSize` bytes is rejected.
+func decodeRecord(record common.LogRecord, buffer []byte, maxSize int, compressor common.Compressor, keyProvider common.KeyProvider) (common.LogRecord, error) {
+    flags := record.Flags()
+    if flags&(common.EncryptionFlag|common.CompressionFlag|common.KeyedFlag) == 0 {
+        return record, nil
+    }
+
+    key, data, err := decodeData(flags, buffer, record.Data(), maxSize, compressor, keyProvider)
+    if err != nil {
+        return nil, err
+    }
+    return &decodedRecord{record, key, data}, nil
+}
+
+// decodeData decrypts and decompresses stored record data with the given
+// flags and splits off its key. The buffer starts with the record header.
+func decodeData(flags uint32, buffer, data []byte, maxSize int, compressor common.Compressor, keyProvider common.KeyProvider) ([]byte, []byte, error) {
+    var err error
+    if flags&common.EncryptionFlag != 0 {
+        if keyProvider == nil {
+            return nil, nil, common.ErrKeyProviderRequired
+        }
+
+        data, err = common.DecryptRecord(keyProvider, buffer[:common.EncryptedHeaderSize], data)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    if flags&common.CompressionFlag != 0 {
+        if compressor == nil {
+            return nil, nil, common.ErrCompressorRequired
+        }
+
+        data, err = compressor.Decompress(data, maxSize)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    var key []byte
+    if flags&common.KeyedFlag != 0 {
+        key, data, err = decodeKeyed(data)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    return key, data, nil
+}
+
+// decodedRecord is a compressed, encrypted or keyed record with its original
+// data and key. The size is the size of the original data without the key.
+type decodedRecord struct {
+    common.LogRecord
+    key  []byte
+    data []byte
+}
+
+// Size returns the size of the original data.
+func (r *decodedRecord) Size() uint32 {
+    return uint32(len(r.data))
+}
+
+// StoredSize returns the size of the data in the data file.
+func (r *decodedRecord) StoredSize() uint32 {
+    return r.LogRecord.Size()
+}
+
+// Key returns the record key.
+func (r *decodedRecord) Key() []byte {
+    return r.key
+}
+
+// Data returns the original data.
+func (r *decodedRecord) Data() []byte {
+    return r.data
+}
+
+// Close closes the cursor's data and index file handles.
+func (c *cursor) Close() error {
+    err := c.data.Close()
+    if err != nil {
+        c.index.Close()
+        return err
+    }
+    return c.index.Close()
+}
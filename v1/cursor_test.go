@@ -0,0 +1,374 @@
+package v1
+
+import (
+    "bytes"
+    "context"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+    "github.com/stretchr/testify/assert"
+)
+
+// writeTestRecords appends `count` 8-byte records to the log. Each record
+// contains its own record index.
+func writeTestRecords(t *testing.T, log common.WriteAheadLog, start, count int) {
+    buffer := make([]byte, 8)
+    for i := start; i < start+count; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+
+        n, err := log.Write(buffer)
+        assert.Nil(t, err)
+        assert.Equal(t, 8+LogRecordHeaderSize, n)
+    }
+}
+
+// ingestExpired appends `count` 8-byte records written two hours ago. Each
+// record contains its own record index.
+func ingestExpired(t *testing.T, log common.WriteAheadLog, start, count int) {
+    var stream bytes.Buffer
+    encoder, err := NewLogRecordEncoder(8, &stream)
+    assert.Nil(t, err)
+
+    written := time.Now().Add(-2 * time.Hour).UnixNano()
+    buffer := make([]byte, 8)
+    for i := start; i < start+count; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+        _, err := encoder(uint64(i), 0, written, buffer)
+        assert.Nil(t, err)
+    }
+    n, err := log.Ingest(&stream)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(count), n)
+}
+
+// recordValue returns the record index stored in a test record.
+func recordValue(t *testing.T, record common.LogRecord) uint64 {
+    value, err := xbinary.LittleEndian.Uint64(record.Data(), 0)
+    assert.Nil(t, err)
+    return value
+}
+
+func TestCursor(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 5)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    assert.NotNil(t, cursor)
+    defer cursor.Close()
+
+    var i uint64
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        assert.Equal(t, uint32(8), record.Size())
+        assert.Equal(t, i, recordValue(t, record))
+        i++
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    assert.Equal(t, uint64(5), i)
+}
+
+func TestCursorSeek(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 5)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.Seek(3)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+
+    record, err = cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(4), recordValue(t, record))
+
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+
+    _, err = cursor.Seek(10)
+    assert.Equal(t, common.ErrEndOfLog, err)
+}
+
+func TestCursorFollowsAppends(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+
+    // records appended after the cursor was created are visible
+    writeTestRecords(t, log, 0, 2)
+    for i := uint64(0); i < 2; i++ {
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, i, recordValue(t, record))
+    }
+
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfLog, err)
+}
+
+func TestCursorSkipsExpired(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.TimeToLive = int64(time.Hour)
+    log := openTestLog(t, dir, config)
+    defer log.Close()
+
+    ingestExpired(t, log, 0, 3)
+    writeTestRecords(t, log, 3, 2)
+
+    // expired records are skipped
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+    assert.Equal(t, uint64(4), cursor.Position())
+
+    record, err = cursor.Seek(1)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+
+    // expired records can be included
+    all, err := log.Cursor(common.WithExpired())
+    assert.Nil(t, err)
+    defer all.Close()
+
+    record, err = all.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), recordValue(t, record))
+}
+
+func TestCursorNextWait(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 1)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    // written records are returned without waiting
+    record, err := cursor.NextWait(context.Background())
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), recordValue(t, record))
+
+    // the cursor waits for the next record to be written
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        writeTestRecords(t, log, 1, 1)
+    }()
+    record, err = cursor.NextWait(context.Background())
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1), recordValue(t, record))
+
+    // the wait ends when the context is cancelled
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    _, err = cursor.NextWait(ctx)
+    assert.Equal(t, context.DeadlineExceeded, err)
+
+    // the wait ends when the log is closed
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        log.Close()
+    }()
+    _, err = cursor.NextWait(context.Background())
+    assert.Equal(t, common.ErrLogClosed, err)
+}
+
+func TestCursorSeekTime(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    start := time.Now()
+    writeTestRecords(t, log, 0, 5)
+    middle := time.Now()
+    writeTestRecords(t, log, 5, 5)
+    end := time.Now()
+    writeTestRecords(t, log, 10, 5)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.SeekTime(middle)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(5), recordValue(t, record))
+    record, err = cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(6), recordValue(t, record))
+
+    record, err = cursor.SeekTime(start)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), recordValue(t, record))
+
+    _, err = cursor.SeekTime(time.Now())
+    assert.Equal(t, common.ErrEndOfLog, err)
+    assert.Equal(t, uint64(15), cursor.Position())
+
+    // the range ends at the first record written after it
+    cursor, err = log.Range(middle, end)
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    for i := uint64(5); i < 10; i++ {
+        record, err = cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, i, recordValue(t, record))
+    }
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEndOfRange, err)
+    _, err = cursor.NextWait(context.Background())
+    assert.Equal(t, common.ErrEndOfRange, err)
+
+    // Prev stops at the start of the range
+    for i := 9; i >= 5; i-- {
+        record, err = cursor.Prev()
+        assert.Nil(t, err)
+        assert.Equal(t, uint64(i), recordValue(t, record))
+    }
+    _, err = cursor.Prev()
+    assert.Equal(t, common.ErrStartOfLog, err)
+    assert.Equal(t, uint64(5), cursor.Position())
+
+    // records after the end of the range are skipped by Prev
+    _, err = cursor.Seek(12)
+    assert.Equal(t, common.ErrEndOfRange, err)
+    record, err = cursor.Prev()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(9), recordValue(t, record))
+}
+
+func TestCursorPrev(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 5)
+
+    // read the log backwards from the end
+    cursor, err := log.Cursor(common.FromEnd())
+    assert.Nil(t, err)
+    defer cursor.Close()
+    assert.Equal(t, uint64(5), cursor.Position())
+
+    for i := 4; i >= 0; i-- {
+        record, err := cursor.Prev()
+        assert.Nil(t, err)
+        assert.Equal(t, uint64(i), recordValue(t, record))
+        assert.Equal(t, uint64(i), cursor.Position())
+    }
+    _, err = cursor.Prev()
+    assert.Equal(t, common.ErrStartOfLog, err)
+
+    // Next after Prev returns the same record
+    _, err = cursor.Seek(3)
+    assert.Nil(t, err)
+    record, err := cursor.Prev()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+    record, err = cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+
+    // records removed from the start are not returned
+    assert.Nil(t, log.TruncateBefore(2))
+    _, err = cursor.Prev()
+    assert.Nil(t, err)
+    _, err = cursor.Prev()
+    assert.Nil(t, err)
+    _, err = cursor.Prev()
+    assert.Equal(t, common.ErrStartOfLog, err)
+    assert.Equal(t, uint64(2), cursor.Position())
+}
+
+func TestCursorFilters(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    // tag every third record with the first flag bit
+    buffer := make([]byte, 8)
+    for i := 0; i < 10; i++ {
+        xbinary.LittleEndian.PutUint64(buffer, 0, uint64(i))
+        var flags uint32 = 0x2
+        if i%3 == 0 {
+            flags |= 0x1
+        }
+        _, err := log.AppendWithFlags(flags, buffer)
+        assert.Nil(t, err)
+    }
+
+    readValues := func(cursor common.LogCursor) []uint64 {
+        defer cursor.Close()
+
+        var values []uint64
+        record, err := cursor.Next()
+        for ; err == nil; record, err = cursor.Next() {
+            values = append(values, recordValue(t, record))
+        }
+        assert.Equal(t, common.ErrEndOfLog, err)
+        return values
+    }
+
+    cursor, err := log.Cursor(common.WithFlags(0x1, 0x1))
+    assert.Nil(t, err)
+    assert.Equal(t, []uint64{0, 3, 6, 9}, readValues(cursor))
+
+    cursor, err = log.Cursor(common.WithFlags(0x3, 0x2))
+    assert.Nil(t, err)
+    assert.Equal(t, []uint64{1, 2, 4, 5, 7, 8}, readValues(cursor))
+
+    // the filter sees the records which pass the flags
+    cursor, err = log.Cursor(common.WithFlags(0x1, 0x1), common.WithFilter(func(record common.LogRecord) bool {
+        return recordValue(t, record) > 3
+    }))
+    assert.Nil(t, err)
+    assert.Equal(t, []uint64{6, 9}, readValues(cursor))
+
+    // filters apply in both directions
+    cursor, err = log.Cursor(common.FromEnd(), common.WithFlags(0x1, 0x1))
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.Prev()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(9), recordValue(t, record))
+    record, err = cursor.Prev()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(6), recordValue(t, record))
+}
@@ -0,0 +1,97 @@
+package v1
+
+import (
+    "bytes"
+    "compress/flate"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestLogEncryption(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    first := bytes.Repeat([]byte{1}, 16)
+    second := bytes.Repeat([]byte{2}, 32)
+    secret := bytes.Repeat([]byte("customer data "), 10)
+
+    config := DefaultConfig
+    config.KeyProvider = common.NewKeyRing(1, map[uint32][]byte{1: first})
+    log := openTestLog(t, dir, config)
+    _, err := log.Write(secret)
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // the data is not stored in plain text
+    data, err := ioutil.ReadFile(filename)
+    assert.Nil(t, err)
+    assert.False(t, bytes.Contains(data, []byte("customer data")))
+
+    // rotate the key, older records are read with their own key
+    config.KeyProvider = common.NewKeyRing(2, map[uint32][]byte{1: first, 2: second})
+    config.Compressor = common.NewFlateCompressor(flate.BestSpeed)
+    log = openTestLog(t, dir, config)
+    _, err = log.Write(secret)
+    assert.Nil(t, err)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    for i := 0; i < 2; i++ {
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, secret, record.Data())
+        assert.Equal(t, uint32(len(secret)), record.Size())
+        assert.Equal(t, common.EncryptionFlag, record.Flags()&common.EncryptionFlag)
+    }
+    assert.Nil(t, cursor.Close())
+    assert.Nil(t, log.Close())
+
+    // a missing key
+    cursor, err = NewCursor(filename, config.MaxRecordSize, common.WithKeyProvider(common.NewKeyRing(2, map[uint32][]byte{2: second})))
+    assert.Nil(t, err)
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrEncryptionKeyNotFound, err)
+    assert.Nil(t, cursor.Close())
+
+    // a changed record timestamp fails authentication
+    data[common.LogHeaderSize+8] ^= 0xff
+    assert.Nil(t, ioutil.WriteFile(filename, data, 0600))
+    cursor, err = NewCursor(filename, config.MaxRecordSize, common.WithKeyProvider(config.KeyProvider))
+    assert.Nil(t, err)
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrDecryptionFailed, err)
+    assert.Nil(t, cursor.Close())
+}
+
+func TestEncryptMaxRecordSize(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.KeyProvider = common.NewKeyRing(1, map[uint32][]byte{1: make([]byte, 16)})
+    log := openTestLog(t, dir, config)
+
+    // the encryption overhead does not count towards the max record size
+    _, err := log.Write(make([]byte, config.MaxRecordSize))
+    assert.Nil(t, err)
+    _, err = log.Write(make([]byte, config.MaxRecordSize+1))
+    assert.Equal(t, common.ErrRecordTooLarge, err)
+    assert.Nil(t, log.Close())
+
+    // the record is read back after recovery
+    log = openTestLog(t, dir, config)
+    defer log.Close()
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+    records := readAllRecords(t, log)
+    if assert.Len(t, records, 1) {
+        assert.Len(t, records[0].Data(), config.MaxRecordSize)
+    }
+}
@@ -0,0 +1,46 @@
+package v1
+
+import (
+    "io"
+
+    "github.com/blacklabeldata/wallaby/common"
+)
+
+// RecordFormat describes how log records are laid out in the data file. The
+// log implementation in this package is shared by newer file versions, only
+// the record format changes between them.
+//
+// Every record header must start with the 4-byte size, the 4-byte flags and
+// the 8-byte timestamp, in that order. The record data immediately follows
+// the header.
+type RecordFormat struct {
+
+    // HeaderSize is the size of each record header.
+    HeaderSize int
+
+    // NewEncoder creates the encoder used to append records to the data file.
+    NewEncoder func(maxSize int, writer io.Writer) (common.LogRecordEncoder, error)
+
+    // Decode validates a record read from the data file and returns it. The
+    // buffer contains the record header followed by the record data. The
+    // expected record index is given so formats which store the index can
+    // verify it.
+    Decode func(index uint64, buffer []byte) (common.LogRecord, error)
+
+    // Verify validates the integrity of a record copied from another log.
+    // Unlike Decode, the record index is not checked.
+    Verify func(buffer []byte) error
+}
+
+// VersionOneFormat is the record format for version 1 log files. Records are
+// not checksummed and the record index is not stored in the data file.
+var VersionOneFormat = RecordFormat{
+    HeaderSize: LogRecordHeaderSize,
+    NewEncoder: NewLogRecordEncoder,
+    Decode: func(index uint64, buffer []byte) (common.LogRecord, error) {
+        return &RawLogRecord{buffer}, nil
+    },
+    Verify: func(buffer []byte) error {
+        return nil
+    },
+}
@@ -3,10 +3,12 @@ package v1
 import (
     "io"
     "os"
+    "sync"
 
     "github.com/blacklabeldata/m3"
     "github.com/blacklabeldata/wallaby/common"
     "github.com/blacklabeldata/xbinary"
+    mmap "github.com/edsrzf/mmap-go"
 )
 
 // NewIndexRecordEncoder writes an `IndexRecord` into a byte array.
@@ -85,7 +87,8 @@ func (i RawIndexRecord) IsExpired(now, ttl int64) bool {
 
 // VersionOneLogHeader starts with a 3-byte string, "IDX", followed by an 8-bit
 // version. After the version, a uint32 represents the boolean flags.
-// The records start immediately following the bit flags.
+// The records start immediately following the bit flags, or following the
+// base record index when the header has the `BaseIndexFlag` set.
 func VersionOneIndexFactory(file *os.File, version uint8, flags uint32, expiration int64) (common.LogIndex, error) {
 
     // get file stat, close file and return on error
@@ -97,7 +100,8 @@ func VersionOneIndexFactory(file *os.File, version uint8, flags uint32, expirati
 
     // get header, on error close file and return
     var header common.FileHeader
-    var size uint64
+    var base, size uint64
+    headerSize := int64(IndexHeaderSize)
 
     // if file already has header
     if stat.Size() >= IndexHeaderSize {
@@ -109,40 +113,34 @@ func VersionOneIndexFactory(file *os.File, version uint8, flags uint32, expirati
             return nil, err
         }
 
-        // determine where the index should start from
-        if size >= IndexHeaderSize+IndexRecordSize {
+        // read the index of the first record
+        base, headerSize, err = readBaseIndex(file, header)
+        if err != nil {
+            file.Close()
+            return nil, err
+        }
 
-            // seek to the last record and try to read the index
-            file.Seek(stat.Size()-IndexRecordSize, 0)
+        // determine how many complete records the index contains
+        var records uint64
+        if stat.Size() > headerSize {
+            records = uint64(stat.Size()-headerSize) / IndexRecordSize
+        }
+        size = base + records
 
-            // if the record cannot be read start back at 0
-            reader := NewIndexRecordDecoder(file)
-            record, err := reader()
+        // if the last record was only partially written truncate the file to
+        // put it back into a good state
+        if end := headerSize + int64(records)*IndexRecordSize; end < stat.Size() {
+            err = file.Truncate(end)
             if err != nil {
-                size = 0
-            } else {
-                size = record.Index()
+                file.Close()
+                return nil, err
             }
-
-            // seek to end of file
-            file.Seek(stat.Size(), 0)
-
-        } else {
-            // if the file diesn't even contain a full record
-            // truncate the file to put it back into a good state
-            size = 0
-            file.Truncate(IndexHeaderSize)
-
-            // seek to end of file header
-            file.Seek(IndexHeaderSize, 0)
-
         }
-        // size = (uint64(stat.Size()) - uint64(IndexHeaderSize)) / uint64(IndexRecordSize)
 
     } else {
 
         // create index header
-        header = common.NewFileHeader(VersionOne, flags, expiration)
+        header = common.NewFileHeader(version, flags, expiration)
 
         // write file header
         _, err := common.WriteFileHeader(common.IndexFileSignature, header, file)
@@ -158,31 +156,61 @@ func VersionOneIndexFactory(file *os.File, version uint8, flags uint32, expirati
         }
     }
 
-    // create writer with buffered middleware
+    // create an unbuffered writer so index records are visible to cursors as
+    // soon as they are appended
     writer := m3.NewFileWriter(file, m3.NoSyncOnWrite)
-    writer.Use(m3.NewBufferedWriter(IndexRecordSize * 8192))
 
-    // writer := bufio.NewWriterSize(file, 64*1024)
     idx := VersionOneIndexFile{
-        writer: writer,
-        header: header,
-        size:   size}
+        file:       file,
+        writer:     writer,
+        header:     header,
+        headerSize: int(headerSize),
+        base:       base,
+        size:       size}
+
+    // map the index file for random access
+    err = idx.grow(size)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
     return &idx, nil
 }
 
 // VersionOneIndexFile implements the IndexFile interface and is created by VersionOneIndexFactory.
+//
+// Index records are appended with regular file writes and read through a
+// read-only memory map of the index file. The mapping is larger than the file
+// and is replaced with a larger one when the index outgrows it.
+//
+// The first index record in the file is for the record at the base index.
+// Record indexes before the base are not in the index.
 type VersionOneIndexFile struct {
-    writer m3.Writer
-    header common.FileHeader
-    size   uint64
+    file       *os.File
+    writer     m3.Writer
+    header     common.FileHeader
+    headerSize int
+    mutex      sync.RWMutex
+    mapping    mmap.MMap
+    base       uint64
+    size       uint64
 }
 
 // Close flushed the index with permanant storage and closes the index.
 func (i *VersionOneIndexFile) Close() error {
+    i.mutex.Lock()
+    defer i.mutex.Unlock()
+
+    if i.mapping != nil {
+        if err := i.mapping.Unmap(); err != nil {
+            i.writer.Close()
+            return err
+        }
+    }
     return i.writer.Close()
 }
 
-// Append adds an index record to the end of the index file. V1 index records have a time, an index and an offset in the data file.
+// Append adds index records to the end of the index file. Several index records can be written at once. V1 index records have a time, an index and an offset in the data file.
 func (i *VersionOneIndexFile) Write(record []byte) (n int, err error) {
 
     // write index buffer to file
@@ -191,24 +219,160 @@ func (i *VersionOneIndexFile) Write(record []byte) (n int, err error) {
         return n, err
     }
 
+    i.mutex.Lock()
+    defer i.mutex.Unlock()
+
+    // grow the mapping to cover the new records
+    records := uint64(n / IndexRecordSize)
+    err = i.grow(i.size + records)
+    if err != nil {
+        return n, err
+    }
+
     // increment index size
-    i.incrementSize()
+    i.size += records
 
     // return num bytes and nil error
     return
 }
 
-// IncrementSize bumps the index size by one.
-func (i *VersionOneIndexFile) incrementSize() {
-    i.size++
+// offset returns the position of an index record in the index file.
+func (i *VersionOneIndexFile) offset(index uint64) int {
+    return i.headerSize + int(index-i.base)*IndexRecordSize
+}
+
+// grow replaces the memory map with a larger one if it does not cover the
+// index records before the given record index. The mapping at least doubles
+// in size each time it grows.
+func (i *VersionOneIndexFile) grow(size uint64) error {
+    end := i.offset(size)
+    if end <= len(i.mapping) {
+        return nil
+    }
+
+    length := 2 * len(i.mapping)
+    if length < i.headerSize+IndexMapRecords*IndexRecordSize {
+        length = i.headerSize + IndexMapRecords*IndexRecordSize
+    }
+    for length < end {
+        length *= 2
+    }
+
+    mapping, err := mmap.MapRegion(i.file, length, mmap.RDONLY, 0, 0)
+    if err != nil {
+        return err
+    }
+
+    if i.mapping != nil {
+        if err := i.mapping.Unmap(); err != nil {
+            mapping.Unmap()
+            return err
+        }
+    }
+    i.mapping = mapping
+    return nil
+}
+
+// Get returns the index record for the given record index directly from the
+// memory map. `ErrSliceOutOfBounds` is returned if the record is before the
+// base index or has not been written.
+func (i *VersionOneIndexFile) Get(index uint64) (common.IndexRecord, error) {
+    i.mutex.RLock()
+    defer i.mutex.RUnlock()
+
+    if i.mapping == nil {
+        return nil, common.ErrLogClosed
+    } else if index < i.base || index >= i.size {
+        return nil, common.ErrSliceOutOfBounds
+    }
+
+    offset := i.offset(index)
+    buffer := make([]byte, IndexRecordSize)
+    copy(buffer, i.mapping[offset:offset+IndexRecordSize])
+    return RawIndexRecord{buffer, 0}, nil
+}
+
+// Slice copies up to `limit` index records starting at the given record index
+// out of the memory map. `ErrSliceOutOfBounds` is returned if the offset is
+// before the base index or past the end of the index.
+func (i *VersionOneIndexFile) Slice(offset uint64, limit uint64) (common.IndexSlice, error) {
+    i.mutex.RLock()
+    defer i.mutex.RUnlock()
+
+    if i.mapping == nil {
+        return nil, common.ErrLogClosed
+    } else if offset < i.base || offset > i.size {
+        return nil, common.ErrSliceOutOfBounds
+    }
+
+    if limit > i.size-offset {
+        limit = i.size - offset
+    }
+
+    start := i.offset(offset)
+    buffer := make([]byte, int(limit)*IndexRecordSize)
+    copy(buffer, i.mapping[start:start+len(buffer)])
+    return IndexSlice{buffer}, nil
+}
+
+// Truncate removes all the index records at or after the given record index
+// from the index file. `ErrIndexOutOfRange` is returned if the record index
+// is before the base index.
+func (i *VersionOneIndexFile) Truncate(size uint64) error {
+    i.mutex.Lock()
+    defer i.mutex.Unlock()
+
+    if size < i.base {
+        return common.ErrIndexOutOfRange
+    }
+
+    err := i.file.Truncate(int64(i.offset(size)))
+    if err != nil {
+        return err
+    }
+
+    i.size = size
+    return i.grow(size)
+}
+
+// Sync flushes the index file to permanent storage.
+func (i *VersionOneIndexFile) Sync() error {
+    return i.file.Sync()
 }
 
 // Size is the number of elements in the index. Which should coorespond with the number of records in the data file.
+// Records before the base index are included, so the size is the record index of the next record.
 func (i *VersionOneIndexFile) Size() uint64 {
+    i.mutex.RLock()
+    defer i.mutex.RUnlock()
     return i.size
 }
 
+// Base returns the record index of the first record in the index.
+func (i *VersionOneIndexFile) Base() uint64 {
+    return i.base
+}
+
 // Header returns the file header which describes the index file.
-func (i VersionOneIndexFile) Header() common.FileHeader {
+func (i *VersionOneIndexFile) Header() common.FileHeader {
     return i.header
 }
+
+// IndexSlice implements the IndexSlice interface over a copy of consecutive
+// index records.
+type IndexSlice struct {
+    buffer []byte
+}
+
+// Get returns the index record at the given position in the slice.
+func (s IndexSlice) Get(index int) (common.IndexRecord, error) {
+    if index < 0 || index >= s.Size() {
+        return nil, common.ErrSliceOutOfBounds
+    }
+    return RawIndexRecord{s.buffer, index * IndexRecordSize}, nil
+}
+
+// Size returns the number of index records in the slice.
+func (s IndexSlice) Size() int {
+    return len(s.buffer) / IndexRecordSize
+}
@@ -0,0 +1,95 @@
+package v1
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// openTestIndex opens the index file in the given directory.
+func openTestIndex(t *testing.T, dir string) common.LogIndex {
+    file, err := os.OpenFile(filepath.Join(dir, "test.idx"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+
+    index, err := VersionOneIndexFactory(file, VersionOne, 0, 0)
+    assert.Nil(t, err)
+    return index
+}
+
+func TestIndexGet(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    index := openTestIndex(t, dir)
+    defer index.Close()
+
+    // write enough records to outgrow the initial mapping
+    encoder := NewIndexRecordEncoder(index)
+    count := uint64(IndexMapRecords*2 + 10)
+    for i := uint64(0); i < count; i++ {
+        _, err := encoder(common.NewIndexRecord(int64(i+1), int64(i*100), i))
+        assert.Nil(t, err)
+    }
+    assert.Equal(t, count, index.Size())
+
+    for _, i := range []uint64{0, 1, IndexMapRecords, count - 1} {
+        record, err := index.Get(i)
+        assert.Nil(t, err)
+        assert.Equal(t, i, record.Index())
+        assert.Equal(t, int64(i*100), record.Offset())
+        assert.Equal(t, int64(i+1), record.Time())
+    }
+
+    // unwritten records are out of bounds
+    _, err := index.Get(count)
+    assert.Equal(t, common.ErrSliceOutOfBounds, err)
+
+    // truncated records are out of bounds
+    assert.Nil(t, index.Truncate(10))
+    _, err = index.Get(10)
+    assert.Equal(t, common.ErrSliceOutOfBounds, err)
+}
+
+func TestIndexSlice(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    index := openTestIndex(t, dir)
+    encoder := NewIndexRecordEncoder(index)
+    for i := uint64(0); i < 10; i++ {
+        _, err := encoder(common.NewIndexRecord(int64(i+1), int64(i*100), i))
+        assert.Nil(t, err)
+    }
+
+    // slice within the index
+    slice, err := index.Slice(2, 5)
+    assert.Nil(t, err)
+    assert.Equal(t, 5, slice.Size())
+    for i := 0; i < slice.Size(); i++ {
+        record, err := slice.Get(i)
+        assert.Nil(t, err)
+        assert.Equal(t, uint64(i+2), record.Index())
+    }
+    _, err = slice.Get(5)
+    assert.Equal(t, common.ErrSliceOutOfBounds, err)
+
+    // slice is clipped at the end of the index
+    slice, err = index.Slice(8, 5)
+    assert.Nil(t, err)
+    assert.Equal(t, 2, slice.Size())
+
+    _, err = index.Slice(11, 1)
+    assert.Equal(t, common.ErrSliceOutOfBounds, err)
+
+    // records are mapped again on reopen
+    assert.Nil(t, index.Close())
+    index = openTestIndex(t, dir)
+    defer index.Close()
+
+    record, err := index.Get(9)
+    assert.Nil(t, err)
+    assert.Equal(t, int64(900), record.Offset())
+}
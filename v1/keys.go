@@ -0,0 +1,312 @@
+package v1
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "os"
+
+    "github.com/OneOfOne/xxhash"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// KeyIndexEntrySize is the size of each entry in a key index file
+const KeyIndexEntrySize = 16
+
+// keyIndex maps the hash of each record key to the record index of the
+// newest record with the key. Every keyed append adds an entry to the key
+// index file, and the file is read into memory when the log is opened, so
+// later entries replace earlier ones.
+//
+// Entries are written before the records they refer to. Entries for records
+// which were never written are dropped when the key index is opened.
+type keyIndex struct {
+    file    *os.File
+    size    int64
+    latest  map[uint64]uint64
+    buffer  bytes.Buffer
+    pending []keyEntry
+}
+
+// keyEntry is a key hash and the record index of a record with the key.
+type keyEntry struct {
+    hash  uint64
+    index uint64
+}
+
+// hashKey returns the hash of a record key.
+func hashKey(key []byte) uint64 {
+    hash := xxhash.New64()
+    hash.Write(key)
+    return hash.Sum64()
+}
+
+// openKeyIndex opens the key index file of a log. If `create` is false and
+// the file does not exist, a nil key index is returned. Entries for record
+// indexes at or after `size` are removed.
+func openKeyIndex(filename string, size uint64, create bool) (*keyIndex, error) {
+    flags := os.O_RDWR
+    if create {
+        flags |= os.O_CREATE
+    }
+
+    file, err := os.OpenFile(filename, flags, 0600)
+    if os.IsNotExist(err) && !create {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    keys := &keyIndex{file: file, latest: make(map[uint64]uint64)}
+    if err := keys.load(size); err != nil {
+        file.Close()
+        return nil, err
+    }
+    return keys, nil
+}
+
+// load reads the entries of the key index file into memory, stopping at the
+// first entry for a record index at or after `size`. The file is truncated
+// after the last entry read.
+func (k *keyIndex) load(size uint64) error {
+    if _, err := k.file.Seek(0, 0); err != nil {
+        return err
+    }
+
+    for key := range k.latest {
+        delete(k.latest, key)
+    }
+    k.size = 0
+
+    reader := bufio.NewReader(k.file)
+    buffer := make([]byte, KeyIndexEntrySize)
+    for {
+        if _, err := io.ReadFull(reader, buffer); err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        } else if err != nil {
+            return err
+        }
+
+        hash, _ := xbinary.LittleEndian.Uint64(buffer, 0)
+        index, _ := xbinary.LittleEndian.Uint64(buffer, 8)
+        if index >= size {
+            break
+        }
+        k.latest[hash] = index
+        k.size += KeyIndexEntrySize
+    }
+
+    if err := k.file.Truncate(k.size); err != nil {
+        return err
+    }
+    _, err := k.file.Seek(k.size, 0)
+    return err
+}
+
+// add buffers an entry for a keyed record until flush writes it.
+func (k *keyIndex) add(hash, index uint64) {
+    entry := make([]byte, KeyIndexEntrySize)
+    xbinary.LittleEndian.PutUint64(entry, 0, hash)
+    xbinary.LittleEndian.PutUint64(entry, 8, index)
+    k.buffer.Write(entry)
+    k.pending = append(k.pending, keyEntry{hash, index})
+}
+
+// rollback discards the buffered entries after the first `pending` entries.
+func (k *keyIndex) rollback(pending int) {
+    k.buffer.Truncate(pending * KeyIndexEntrySize)
+    k.pending = k.pending[:pending]
+}
+
+// flush writes the buffered entries and adds them to the in-memory index.
+func (k *keyIndex) flush() error {
+    if len(k.pending) == 0 {
+        return nil
+    }
+
+    // discard the buffered entries once they have been written or failed
+    defer func() {
+        k.buffer.Reset()
+        k.pending = k.pending[:0]
+    }()
+
+    // remove a partially written entry so later entries stay aligned
+    if _, err := k.file.Write(k.buffer.Bytes()); err != nil {
+        k.file.Truncate(k.size)
+        k.file.Seek(k.size, 0)
+        return err
+    }
+    k.size += int64(k.buffer.Len())
+
+    for _, entry := range k.pending {
+        k.latest[entry.hash] = entry.index
+    }
+    return nil
+}
+
+// get returns the record index of the newest record with the given key hash.
+func (k *keyIndex) get(hash uint64) (uint64, bool) {
+    index, ok := k.latest[hash]
+    return index, ok
+}
+
+// reset removes every entry.
+func (k *keyIndex) reset() error {
+    if err := k.file.Truncate(0); err != nil {
+        return err
+    }
+    if _, err := k.file.Seek(0, 0); err != nil {
+        return err
+    }
+
+    k.size = 0
+    for key := range k.latest {
+        delete(k.latest, key)
+    }
+    return nil
+}
+
+// Sync flushes the key index file to permanent storage.
+func (k *keyIndex) Sync() error {
+    return k.file.Sync()
+}
+
+// Close closes the key index file.
+func (k *keyIndex) Close() error {
+    return k.file.Close()
+}
+
+// ## **Keyed Records**
+
+// encodeKeyed prefixes the record data with the key and its 4-byte length.
+func encodeKeyed(key, data []byte) []byte {
+    buffer := make([]byte, 4+len(key)+len(data))
+    xbinary.LittleEndian.PutUint32(buffer, 0, uint32(len(key)))
+    copy(buffer[4:], key)
+    copy(buffer[4+len(key):], data)
+    return buffer
+}
+
+// decodeKeyed splits keyed record data into the key and the data.
+func decodeKeyed(buffer []byte) ([]byte, []byte, error) {
+    size, err := xbinary.LittleEndian.Uint32(buffer, 0)
+    if err != nil || uint64(len(buffer)-4) < uint64(size) {
+        return nil, nil, common.ErrInvalidRecordKey
+    }
+    return buffer[4 : 4+size], buffer[4+size:], nil
+}
+
+// AppendKeyed appends a record with a key and returns its record index. The
+// key is stored with the record data, before the data is compressed and
+// encrypted, and the record gets the `KeyedFlag`. The key index is created
+// by the first keyed append.
+func (w *wal) AppendKeyed(key, data []byte) (uint64, error) {
+    if !w.reserved {
+        return 0, common.ErrReservedFlagsUnsupported
+    }
+
+    index, _, err := w.write(w.flags|common.KeyedFlag, [][]byte{encodeKeyed(key, data)})
+    return index, err
+}
+
+// GetLatest returns the newest record with the given key. The key index
+// finds the record without scanning the log; if the record it points to does
+// not have the key, because of a hash collision or because the record was
+// removed, the log is scanned backwards instead. Expired records are
+// returned. `ErrKeyNotFound` is returned if no record has the key.
+func (w *wal) GetLatest(key []byte) (common.LogRecord, error) {
+    hash := hashKey(key)
+
+    w.mutex.Lock()
+    var index uint64
+    var ok bool
+    if w.keys != nil {
+        index, ok = w.keys.get(hash)
+    }
+    w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return nil, common.ErrLogClosed
+    } else if !ok {
+        return nil, common.ErrKeyNotFound
+    }
+
+    cursor, err := w.Cursor(common.WithExpired(), common.StartAt(index))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close()
+
+    record, err := cursor.Next()
+    if err == nil && cursor.Position() == index+1 && bytes.Equal(record.Key(), key) {
+        return record, nil
+    } else if err != nil && err != common.ErrEndOfLog {
+        return nil, err
+    }
+    return w.scanLatest(key)
+}
+
+// scanLatest reads the keyed records backwards from the end of the log to
+// find the newest record with the given key.
+func (w *wal) scanLatest(key []byte) (common.LogRecord, error) {
+    cursor, err := w.Cursor(common.WithExpired(), common.FromEnd(), common.WithFlags(common.KeyedFlag, common.KeyedFlag))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close()
+
+    record, err := cursor.Prev()
+    for ; err == nil; record, err = cursor.Prev() {
+        if bytes.Equal(record.Key(), key) {
+            return record, nil
+        }
+    }
+    if err == common.ErrStartOfLog {
+        return nil, common.ErrKeyNotFound
+    }
+    return nil, err
+}
+
+// addKey buffers a key index entry for a keyed record which is about to be
+// appended at the given record index. The key index is created if it does
+// not exist yet.
+func (w *wal) addKey(index uint64, key []byte) error {
+    if w.keys == nil {
+        keys, err := openKeyIndex(w.filename+".keys", w.index.Size(), true)
+        if err != nil {
+            return err
+        }
+        w.keys = keys
+    }
+    w.keys.add(hashKey(key), index)
+    return nil
+}
+
+// rebuildKeys recreates the key index from the keyed records in the log.
+func (w *wal) rebuildKeys() error {
+    if w.keys == nil {
+        return nil
+    } else if err := w.keys.reset(); err != nil {
+        return err
+    }
+
+    cursor, err := w.Cursor(common.WithExpired(), common.WithFlags(common.KeyedFlag, common.KeyedFlag))
+    if err != nil {
+        return err
+    }
+    defer cursor.Close()
+
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        w.keys.add(hashKey(record.Key()), cursor.Position()-1)
+    }
+    if err != common.ErrEndOfLog {
+        return err
+    }
+
+    if err := w.keys.flush(); err != nil {
+        return err
+    }
+    return w.keys.Sync()
+}
@@ -0,0 +1,80 @@
+package v1
+
+import (
+    "compress/flate"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// assertLatest checks the newest value of a key.
+func assertLatest(t *testing.T, log common.WriteAheadLog, key, value string) {
+    record, err := log.GetLatest([]byte(key))
+    assert.Nil(t, err)
+    if assert.NotNil(t, record) {
+        assert.Equal(t, []byte(key), record.Key())
+        assert.Equal(t, []byte(value), record.Data())
+        assert.Equal(t, common.KeyedFlag, record.Flags()&common.KeyedFlag)
+    }
+}
+
+func TestKeyedRecords(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.Compressor = common.NewFlateCompressor(flate.BestSpeed)
+    config.KeyProvider = common.NewKeyRing(1, map[uint32][]byte{1: make([]byte, 16)})
+    log := openTestLog(t, dir, config)
+
+    // no key index until the first keyed record
+    _, err := log.Write([]byte("unkeyed"))
+    assert.Nil(t, err)
+    _, err = log.GetLatest([]byte("a"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, err = os.Stat(filepath.Join(dir, "test.log.keys"))
+    assert.True(t, os.IsNotExist(err))
+
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"b", "2"}, {"a", "3"}} {
+        _, err := log.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+    assertLatest(t, log, "a", "3")
+    assertLatest(t, log, "b", "2")
+    _, err = log.GetLatest([]byte("c"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    // unkeyed records have no key
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    record, err := cursor.Next()
+    assert.Nil(t, err)
+    assert.Nil(t, record.Key())
+    assert.Equal(t, []byte("unkeyed"), record.Data())
+    assert.Nil(t, cursor.Close())
+    assert.Nil(t, log.Close())
+
+    // the key index is read back, records removed from the end fall back to
+    // the previous value
+    log = openTestLog(t, dir, config)
+    assertLatest(t, log, "a", "3")
+    assert.Nil(t, log.TruncateAfter(4))
+    assertLatest(t, log, "a", "2")
+    assertLatest(t, log, "b", "2")
+    assert.Nil(t, log.Close())
+
+    // a lost key index is rebuilt by recovery
+    assert.Nil(t, os.Truncate(filepath.Join(dir, "test.log.keys"), 0))
+    log = openTestLog(t, dir, config)
+    defer log.Close()
+    _, err = log.Recover()
+    assert.Nil(t, err)
+    stat, err := os.Stat(filepath.Join(dir, "test.log.keys"))
+    assert.Nil(t, err)
+    assert.Equal(t, int64(4*KeyIndexEntrySize), stat.Size())
+    assertLatest(t, log, "a", "2")
+    assertLatest(t, log, "b", "2")
+}
@@ -1,9 +1,12 @@
 package v1
 
 import (
+    "bytes"
     "hash"
     "io"
     "os"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/OneOfOne/xxhash"
@@ -14,13 +17,14 @@ import (
 
 // DefaultConfig can be used for sensible default log configuration.
 var DefaultConfig common.Config = common.Config{
-    FileMode:      0600,
-    MaxRecordSize: common.DefaultMaxRecordSize,
-    Flags:         common.DefaultRecordFlags,
-    Version:       VersionOne,
-    Truncate:      false,
-    TimeToLive:    0,
-    Strategy:      m3.NoSyncOnWrite,
+    FileMode:           0600,
+    MaxRecordSize:      common.DefaultMaxRecordSize,
+    Flags:              common.DefaultRecordFlags,
+    Version:            VersionOne,
+    Truncate:           false,
+    TimeToLive:         0,
+    Strategy:           m3.NoSyncOnWrite,
+    TombstoneRetention: common.DefaultTombstoneRetention,
 }
 
 // NewLogRecordEncoder creates a new LogRecordFactory which validates records are smaller than the given maxSize.
@@ -95,6 +99,16 @@ func (i *RawLogRecord) Size() uint32 {
     return size
 }
 
+// StoredSize is the size of the record payload in the data file
+func (i *RawLogRecord) StoredSize() uint32 {
+    return i.Size()
+}
+
+// Key is nil, keys are decoded by the cursor
+func (i *RawLogRecord) Key() []byte {
+    return nil
+}
+
 // Flags returns the boolean flags for the record
 func (i *RawLogRecord) Flags() uint32 {
     flags, err := xbinary.LittleEndian.Uint32(i.buffer, 4)
@@ -133,22 +147,49 @@ func (i *RawLogRecord) IsExpired(now, ttl int64) bool {
 
 // ###### *Implementation*
 func Create(file *os.File, filename string, config common.Config) (common.WriteAheadLog, error) {
+    return CreateWithFormat(file, filename, config, VersionOneFormat)
+}
 
-    // try to open index file, return error on fail
-    idxFile, err := os.OpenFile(filename+".idx", os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
-    if err != nil {
-        return nil, err
+// ### **Creates a log file with the given record format**
+// Newer file versions share the v1 index and log implementation and only
+// provide their own record format.
+
+// When `config.Truncate` is set the data file has been truncated by the
+// caller, so the index, the key index and any files left by an interrupted
+// file swap are removed along with it.
+
+// ###### *Implementation*
+func CreateWithFormat(file *os.File, filename string, config common.Config, format RecordFormat) (common.WriteAheadLog, error) {
+
+    // the files of the truncated log would not match the new data file
+    if config.Truncate {
+        for _, suffix := range []string{".idx", ".keys", ".tmp", ".idx.tmp", ".swap"} {
+            if err := os.Remove(filename + suffix); err != nil && !os.IsNotExist(err) {
+                file.Close()
+                return nil, err
+            }
+        }
     }
 
-    // hash
-    hash := xxhash.New64()
-    io.Copy(hash, idxFile)
-    idxFile.Seek(0, 0)
+    // records are encoded with at most `config.MaxRecordSize` bytes of data
+    maxRecordSize := config.MaxRecordSize
+    if maxRecordSize <= 0 {
+        file.Close()
+        return nil, common.ErrInvalidMaxRecordSize
+    }
 
-    index, err := VersionOneIndexFactory(idxFile, config.Version, config.Flags, config.TimeToLive)
+    // finish or discard a file swap interrupted by a crash. The data file is
+    // opened again if it was replaced.
+    replaced, err := finishSwap(filename)
     if err != nil {
         file.Close()
         return nil, err
+    } else if replaced {
+        file.Close()
+        file, err = os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0600)
+        if err != nil {
+            return nil, err
+        }
     }
 
     // Stat the file to get the size. If unsuccessful, close the file and return the error.
@@ -158,33 +199,161 @@ func Create(file *os.File, filename string, config common.Config) (common.WriteA
         return nil, err
     }
 
-    // create log writer
-    writer, err := m3.NewMemMapAppender(file, 512*1024, stat.Size())
+    // read the index of the first record in the data file
+    header, err := common.ReadFileHeader(io.NewSectionReader(file, 0, LogHeaderSize))
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    base, headerSize, err := readBaseIndex(file, header)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    // files created before the flags were reserved only have user flags, so
+    // features which store reserved flags in the records cannot be used
+    reserved := header.Version()&common.ReservedFlagsFeature != 0
+    if reserved && config.Flags&common.ReservedFlags != 0 {
+        file.Close()
+        return nil, common.ErrReservedFlags
+    } else if !reserved && (config.Compressor != nil || config.KeyProvider != nil) {
+        file.Close()
+        return nil, common.ErrReservedFlagsUnsupported
+    }
+
+    // try to open index file, return error on fail. A new index file gets
+    // the same reserved flags feature as the data file.
+    idxFile, err := os.OpenFile(filename+".idx", os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
     if err != nil {
+        file.Close()
         return nil, err
     }
 
-    logRecordEncoder, err := NewLogRecordEncoder(64*1024, writer)
+    index, err := VersionOneIndexFactory(idxFile, VersionOne|header.Version()&common.ReservedFlagsFeature, config.Flags, config.TimeToLive)
     if err != nil {
+        file.Close()
         return nil, err
     }
 
-    return &wal{
-        filename:           filename,
-        logWriter:          writer,
-        index:              index,
-        logRecordEncoder:   logRecordEncoder,
-        indexRecordEncoder: NewIndexRecordEncoder(index),
-        hashWriter:         NewIndexRecordEncoder(hash),
-        hash:               hash,
-        lastWriteTime:      0,
-        flags:              config.Flags,
-        logSize:            stat.Size(),
-    }, nil
+    // create log writer using the configured write strategy. Group commit
+    // syncs each batch itself so the writes are not synced.
+    strategy := config.Strategy
+    if config.GroupCommit.MaxRecords > 0 {
+        strategy = m3.NoSyncOnWrite
+    }
+    writer := m3.NewFileWriter(file, strategy)
+
+    hash := xxhash.New64()
+    w := &wal{
+        filename:      filename,
+        file:          file,
+        logWriter:     writer,
+        index:         index,
+        hashWriter:    NewIndexRecordEncoder(hash),
+        hash:          hash,
+        lastWriteTime: 0,
+        flags:         config.Flags,
+        reserved:      reserved,
+        base:          base,
+        headerSize:    headerSize,
+        logSize:       headerSize,
+        maxRecordSize: maxRecordSize,
+        format:        format,
+        strategy:      strategy,
+        compressor:    config.Compressor,
+        keyProvider:   config.KeyProvider,
+        retention:     config.TombstoneRetention,
+    }
+
+    // records are encoded into buffers which are written by flush
+    w.logRecordEncoder, err = format.NewEncoder(maxStoredSize(maxRecordSize), &w.dataBuffer)
+    if err != nil {
+        index.Close()
+        file.Close()
+        return nil, err
+    }
+    w.indexRecordEncoder = NewIndexRecordEncoder(&w.indexBuffer)
+
+    // restore the state of an existing log from the index
+    err = w.restore(stat.Size())
+    if err != nil {
+        w.Close()
+        return nil, err
+    }
+
+    // open the key index if the log has keyed records
+    w.keys, err = openKeyIndex(filename+".keys", w.index.Size(), false)
+    if err != nil {
+        w.Close()
+        return nil, err
+    }
+
+    // publish the restored records to cursors
+    atomic.StoreUint64(&w.tail, w.index.Size())
+    atomic.StoreUint32(&w.state, uint32(common.OPEN))
+
+    // start committing batches of concurrent writes
+    if config.GroupCommit.MaxRecords > 0 {
+        w.commits = make(chan *commitRequest)
+        w.done = make(chan struct{})
+        w.wait.Add(1)
+        go w.committer(config.GroupCommit, w.commits, w.done)
+    }
+    return w, nil
 }
 
+// restore rebuilds the in-memory state of the log from the index file. The
+// running hash covers every index record, the log size is the end of the last
+// indexed record and the last write time is the time of the last indexed
+// record. If the data file does not end where the index says it should, or
+// the files do not start at the same record, the log must be recovered
+// before more records can be written.
+func (w *wal) restore(dataSize int64) error {
+    if w.index.Base() != w.base {
+        w.recoveryRequired = true
+        return nil
+    }
+
+    size := w.index.Size()
+    if size > w.base {
+
+        // hash all the index records
+        if err := w.rehash(); err != nil {
+            return err
+        }
+
+        // read the last index record
+        last, err := w.index.Get(size - 1)
+        if err != nil {
+            return err
+        }
+        w.lastWriteTime = last.Time()
+
+        // read the size of the last record to find the end of the log
+        header := make([]byte, w.format.HeaderSize)
+        if n, _ := w.file.ReadAt(header, last.Offset()); n < w.format.HeaderSize {
+            w.recoveryRequired = true
+            return nil
+        }
+        recordSize, _ := xbinary.LittleEndian.Uint32(header, 0)
+        w.logSize = last.Offset() + int64(w.format.HeaderSize) + int64(recordSize)
+    }
+
+    w.recoveryRequired = w.logSize != dataSize
+    return nil
+}
+
+// wal implements the WriteAheadLog interface. It is safe for concurrent use
+// by one writer and any number of cursors. Writes are serialized by the
+// mutex. Cursors only read records before the published tail, which is moved
+// after a record and its index record have been completely written.
 type wal struct {
+    mutex              sync.Mutex
+    state              uint32
+    tail               uint64
     filename           string
+    file               *os.File
     logWriter          io.WriteCloser
     index              common.LogIndex
     logRecordEncoder   common.LogRecordEncoder
@@ -194,39 +363,309 @@ type wal struct {
     lastWriteTime      int64
     flags              uint32
     logSize            int64
+    maxRecordSize      int
+    format             RecordFormat
+    strategy           m3.WriteStrategy
+    compressor         common.Compressor
+    keyProvider        common.KeyProvider
+    keys               *keyIndex
+    reserved           bool
+    retention          time.Duration
+    recoveryRequired   bool
+    notifier           common.Notifier
+
+    // the record index of the first record and the size of the data file
+    // header, which grows when the file does not start at record index 0
+    base       uint64
+    headerSize int64
+
+    // the data and index files are replaced while files is locked, the
+    // generation is incremented each time
+    files      sync.RWMutex
+    generation uint64
+
+    // records which have been encoded but not yet written
+    dataBuffer  bytes.Buffer
+    indexBuffer bytes.Buffer
+    pending     []common.IndexRecord
+
+    // group commit
+    commits chan *commitRequest
+    done    chan struct{}
+    wait    sync.WaitGroup
 }
 
+// Write appends a record to the log. With group commit enabled the record is
+// queued and written with other concurrent writes, and Write returns after
+// the batch has been synced.
 func (w *wal) Write(data []byte) (int, error) {
+    _, n, err := w.write(w.flags, [][]byte{data})
+    return n, err
+}
 
-    // record attrs
-    now := time.Now().UnixNano()
-    size := w.index.Size()
+// Append appends a record with the default flags and returns its record
+// index.
+func (w *wal) Append(data []byte) (uint64, error) {
+    return w.AppendWithFlags(w.flags, data)
+}
+
+// AppendWithFlags appends a record with the given flags and returns its
+// record index. `ErrReservedFlags` is returned if the flags use bits reserved
+// by the log.
+func (w *wal) AppendWithFlags(flags uint32, data []byte) (uint64, error) {
+    if w.reserved && flags&common.ReservedFlags != 0 {
+        return 0, common.ErrReservedFlags
+    }
+
+    index, _, err := w.write(flags, [][]byte{data})
+    return index, err
+}
+
+// WriteBatch appends the records as an atomic batch. Every record except the
+// last has the `BatchFlag` set, recovery removes the records of a batch
+// which does not end with a record without the flag. The records are written
+// to the data and index files with a single write each and are published to
+// cursors together. Files without the reserved record flags only accept
+// single records.
+func (w *wal) WriteBatch(records [][]byte) (int, error) {
+    if !w.reserved && len(records) > 1 {
+        return 0, common.ErrReservedFlagsUnsupported
+    }
+
+    _, n, err := w.write(w.flags, records)
+    return n, err
+}
+
+// write appends the records as an atomic batch with the given flags. The
+// record index of the first record and the number of bytes written are
+// returned.
+func (w *wal) write(flags uint32, records [][]byte) (uint64, int, error) {
+    if len(records) == 0 {
+        return 0, 0, nil
+    } else if w.commits != nil {
+        return w.groupCommit(&commitRequest{flags: flags, records: records})
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
 
-    // write log record
-    n, err := w.logRecordEncoder(size, w.flags, now, data)
+    if w.State() == common.CLOSED {
+        return 0, 0, common.ErrLogClosed
+    }
+
+    index, n, err := w.appendBatch(flags, time.Now().UnixNano(), records)
     if err != nil {
-        return n, err
+        return 0, n, err
+    }
+    return index, n, w.flush()
+}
+
+// appendBatch encodes the records into the write buffers as one batch and
+// returns the record index of the first record. If a record cannot be
+// encoded none of the records are kept.
+func (w *wal) appendBatch(flags uint32, now int64, records [][]byte) (uint64, int, error) {
+    dataSize, indexSize, pending := w.dataBuffer.Len(), w.indexBuffer.Len(), len(w.pending)
+    index := w.index.Size() + uint64(pending)
+
+    var keysPending int
+    if w.keys != nil {
+        keysPending = len(w.keys.pending)
     }
 
-    // write index record
-    indexRecord := common.NewIndexRecord(now, w.logSize, size)
-    _, err = w.indexRecordEncoder(indexRecord)
+    var total int
+    for i, data := range records {
+        recordFlags := flags
+        if i < len(records)-1 {
+            recordFlags |= common.BatchFlag
+        }
+
+        // the max record size applies to the data before it is compressed
+        // and encrypted
+        var err error
+        if len(data) > w.maxRecordSize {
+            err = common.ErrRecordTooLarge
+        }
+
+        // keyed records get a key index entry
+        if err == nil && w.reserved && recordFlags&common.KeyedFlag != 0 {
+            var key []byte
+            if key, _, err = decodeKeyed(data); err == nil {
+                err = w.addKey(index+uint64(i), key)
+            }
+        }
+
+        // the compressed and encrypted data is what gets stored
+        var stored []byte
+        if err == nil {
+            stored, recordFlags, err = w.compress(data, recordFlags)
+        }
+        if err == nil {
+            stored, recordFlags, err = w.encrypt(stored, recordFlags, now)
+        }
+        var n int
+        if err == nil {
+            n, err = w.append(recordFlags, now, stored)
+        }
+        if err != nil {
+            w.dataBuffer.Truncate(dataSize)
+            w.indexBuffer.Truncate(indexSize)
+            w.pending = w.pending[:pending]
+            if w.keys != nil {
+                w.keys.rollback(keysPending)
+            }
+            return 0, 0, err
+        }
+        total += n
+    }
+    return index, total, nil
+}
+
+// compress compresses the record data with the log's compressor and sets the
+// `CompressionFlag`. Data which does not get smaller is left uncompressed.
+func (w *wal) compress(data []byte, flags uint32) ([]byte, uint32, error) {
+    if w.compressor == nil {
+        return data, flags, nil
+    }
+
+    compressed, err := w.compressor.Compress(data)
     if err != nil {
-        return n, err
+        return nil, flags, err
+    } else if len(compressed) >= len(data) {
+        return data, flags, nil
     }
+    return compressed, flags | common.CompressionFlag, nil
+}
 
-    // add log size
-    w.logSize += int64(n)
-    w.lastWriteTime = now
+// maxStoredSize returns the largest record data stored in the data file for
+// records with at most `maxSize` bytes of data. Encryption adds
+// `common.EncryptionOverhead` bytes to the data of each record.
+func maxStoredSize(maxSize int) int {
+    return maxSize + common.EncryptionOverhead
+}
 
-    // Update log checksum
-    w.hashWriter(indexRecord)
+// encrypt encrypts the record data with the current key of the log's key
+// provider and sets the `EncryptionFlag`. The size, flags and timestamp the
+// record is written with are authenticated along with the data.
+func (w *wal) encrypt(data []byte, flags uint32, now int64) ([]byte, uint32, error) {
+    if w.keyProvider == nil {
+        return data, flags, nil
+    }
+
+    flags |= common.EncryptionFlag
+    header := make([]byte, common.EncryptedHeaderSize)
+    xbinary.LittleEndian.PutUint32(header, 0, uint32(len(data)+common.EncryptionOverhead))
+    xbinary.LittleEndian.PutUint32(header, 4, flags)
+    xbinary.LittleEndian.PutInt64(header, 8, now)
+
+    encrypted, err := common.EncryptRecord(w.keyProvider, header, data)
+    if err != nil {
+        return nil, flags, err
+    }
+    return encrypted, flags, nil
+}
+
+// append encodes a record with the given flags and timestamp and its index
+// record into the write buffers. The record is not part of the log until the
+// buffers are written by flush.
+func (w *wal) append(flags uint32, now int64, data []byte) (int, error) {
+
+    // refuse to append to an inconsistent log
+    if w.recoveryRequired {
+        return 0, common.ErrRecoveryRequired
+    }
+
+    // record attrs
+    size := w.index.Size() + uint64(len(w.pending))
+    offset := w.logSize + int64(w.dataBuffer.Len())
+
+    // encode log record
+    n, err := w.logRecordEncoder(size, flags, now, data)
+    if err != nil {
+        return n, err
+    }
+
+    // encode index record
+    indexRecord := common.NewIndexRecord(now, offset, size)
+    w.indexRecordEncoder(indexRecord)
+    w.pending = append(w.pending, indexRecord)
 
     // return
     return n, nil
 }
 
+// flush writes the buffered records to the data file followed by their index
+// records. If either write fails the files may no longer agree, so the log
+// must be recovered before more records are written.
+func (w *wal) flush() error {
+    if len(w.pending) == 0 {
+        return nil
+    }
+
+    // discard the buffered records once they have been written or failed
+    defer func() {
+        w.dataBuffer.Reset()
+        w.indexBuffer.Reset()
+        w.pending = w.pending[:0]
+    }()
+
+    // write key index entries before the records they refer to
+    if w.keys != nil {
+        if err := w.keys.flush(); err != nil {
+            return err
+        }
+    }
+
+    // write log records
+    if _, err := w.logWriter.Write(w.dataBuffer.Bytes()); err != nil {
+        w.recoveryRequired = true
+        return err
+    }
+
+    // write index records
+    if _, err := w.index.Write(w.indexBuffer.Bytes()); err != nil {
+        w.recoveryRequired = true
+        return err
+    }
+
+    // publish the records to cursors
+    atomic.StoreUint64(&w.tail, w.index.Size())
+    w.notifier.Notify()
+
+    // add log size
+    w.logSize += int64(w.dataBuffer.Len())
+    w.lastWriteTime = w.pending[len(w.pending)-1].Time()
+
+    // Update log checksum
+    for _, record := range w.pending {
+        w.hashWriter(record)
+    }
+    return nil
+}
+
+// Close closes the data and index files. Writes which are already queued
+// for group commit are committed first. Closing a closed log returns
+// `ErrLogClosed`.
 func (w *wal) Close() error {
+    if common.State(atomic.SwapUint32(&w.state, uint32(common.CLOSED))) == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    // wake waiting cursors
+    w.notifier.Notify()
+
+    // stop committing
+    if w.commits != nil {
+        close(w.done)
+        w.wait.Wait()
+    }
+
+    // wait for a write in progress
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.keys != nil {
+        w.keys.Close()
+    }
 
     // close log writer
     err := w.logWriter.Close()
@@ -239,21 +678,99 @@ func (w *wal) Close() error {
     return w.index.Close()
 }
 
-func (w *wal) Recover() error {
-    return nil
+// Cursor opens a new cursor positioned at the first record of the log. The
+// cursor reads records from the data file through its own read-only handle
+// and finds them with the log's index. It only reads records which have been
+// published by the writer.
+func (w *wal) Cursor(options ...common.CursorOption) (common.LogCursor, error) {
+    if w.State() == common.CLOSED {
+        return nil, common.ErrLogClosed
+    }
+
+    w.files.RLock()
+    defer w.files.RUnlock()
+
+    data, err := os.Open(w.filename)
+    if err != nil {
+        return nil, err
+    }
+
+    c := &cursor{
+        log:        w,
+        generation: w.generation,
+        data:       data,
+        index:      walIndexReader{w},
+        maxSize:    w.maxRecordSize,
+        format:     w.format,
+        ttl:        w.index.Header().Expiration(),
+        reserved:   w.reserved,
+        options:    common.NewCursorOptions(options...),
+    }
+    if c.options.Compressor == nil {
+        c.options.Compressor = w.compressor
+    }
+    if c.options.KeyProvider == nil {
+        c.options.KeyProvider = w.keyProvider
+    }
+    c.position = c.start()
+    return c, nil
+}
+
+// Range creates a cursor positioned at the first record written at or after
+// `from` which ends at the first record written at or after `to`.
+func (w *wal) Range(from, to time.Time, options ...common.CursorOption) (common.LogCursor, error) {
+    options = append(options[:len(options):len(options)], common.Since(from), common.Until(to))
+    logCursor, err := w.Cursor(options...)
+    if err != nil {
+        return nil, err
+    }
+
+    c := logCursor.(*cursor)
+    position, err := searchTime(c.index, from.UnixNano())
+    if err != nil {
+        c.Close()
+        return nil, err
+    }
+    c.position = position
+    return c, nil
 }
 
-func (w *wal) Cursor() (common.LogCursor, error) {
-    return nil, nil
+// State returns whether the log is open or closed.
+func (w *wal) State() common.State {
+    return common.State(atomic.LoadUint32(&w.state))
+}
+
+// published returns the index record of a published record. `ErrEndOfLog` is
+// returned if the record has not been published. The files lock must be
+// held.
+func (w *wal) published(position uint64) (common.IndexRecord, error) {
+    if w.State() == common.CLOSED {
+        return nil, common.ErrLogClosed
+    } else if position >= atomic.LoadUint64(&w.tail) {
+        return nil, common.ErrEndOfLog
+    }
+
+    // the record may have been removed by recovery since the tail was read
+    record, err := w.index.Get(position)
+    if err == common.ErrSliceOutOfBounds {
+        return nil, common.ErrEndOfLog
+    }
+    return record, err
 }
 
 func (w *wal) Snapshot() (common.Snapshot, error) {
-    return common.NewSnapshot(w.lastWriteTime, w.logSize, w.hash.Sum64()), nil
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return common.NewSnapshot(w.lastWriteTime, int64(w.index.Size()), w.hash.Sum64()), nil
 }
 
 func (w *wal) Metadata() (common.Metadata, error) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
     meta := common.Metadata{
         Size:             w.logSize,
+        Records:          w.index.Size(),
         LastModifiedTime: w.lastWriteTime,
         FileName:         w.filename,
         IndexFileName:    w.filename + ".idx",
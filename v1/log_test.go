@@ -0,0 +1,305 @@
+package v1
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sync"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// createTestDir creates a temporary directory for the test log files.
+func createTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "wallaby-v1")
+    assert.Nil(t, err, "Test dir could not be created")
+    return dir
+}
+
+// openTestLog opens the log file in the given directory the same way
+// `wallaby.Create` does, writing the file header for new files.
+func openTestLog(t *testing.T, dir string, config common.Config) common.WriteAheadLog {
+    filename := filepath.Join(dir, "test.log")
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, config.FileMode)
+    assert.Nil(t, err)
+
+    stat, err := file.Stat()
+    assert.Nil(t, err)
+    if stat.Size() < common.LogHeaderSize {
+        header := common.NewFileHeader(config.Version|common.ReservedFlagsFeature, config.Flags, config.TimeToLive)
+        _, err = common.WriteFileHeader(common.LogFileSignature, header, file)
+        assert.Nil(t, err)
+    }
+
+    log, err := Create(file, filename, config)
+    assert.Nil(t, err)
+    assert.NotNil(t, log)
+    return log
+}
+
+func TestLogWrite(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    // append record
+    n, err := log.Write(make([]byte, 64))
+    assert.Nil(t, err)
+    assert.Equal(t, 64+LogRecordHeaderSize, n)
+
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(LogHeaderSize+LogRecordHeaderSize+64), meta.Size)
+}
+
+func TestLogMaxRecordSize(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    config := DefaultConfig
+    config.MaxRecordSize = 16
+    log := openTestLog(t, dir, config)
+    defer log.Close()
+
+    // records are limited by the configured size
+    _, err := log.Write(make([]byte, 16))
+    assert.Nil(t, err)
+    _, err = log.Write(make([]byte, 17))
+    assert.Equal(t, common.ErrRecordTooLarge, err)
+
+    file, err := os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    config.MaxRecordSize = 0
+    _, err = Create(file, filename, config)
+    assert.Equal(t, common.ErrInvalidMaxRecordSize, err)
+}
+
+func TestLogTruncateOnOpen(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    _, err := log.AppendKeyed([]byte("a"), []byte("1"))
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // the data file is truncated by `wallaby.Create` before the header is
+    // written again
+    config := DefaultConfig
+    config.Truncate = true
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    assert.Nil(t, file.Truncate(0))
+    header := common.NewFileHeader(config.Version|common.ReservedFlagsFeature, config.Flags, config.TimeToLive)
+    _, err = common.WriteFileHeader(common.LogFileSignature, header, file)
+    assert.Nil(t, err)
+    log, err = Create(file, filename, config)
+    assert.Nil(t, err)
+
+    // the index and the key index are truncated with the data file
+    writeTestRecords(t, log, 7, 1)
+    records := readAllRecords(t, log)
+    if assert.Len(t, records, 1) {
+        assert.Equal(t, uint64(7), recordValue(t, records[0]))
+    }
+    _, err = log.GetLatest([]byte("a"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    assert.Nil(t, log.Close())
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+    assert.Len(t, readAllRecords(t, log), 1)
+}
+
+func TestLogReopen(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // the reopened log has the same state as before it was closed
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    reopenedMeta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, meta, reopenedMeta)
+
+    reopenedSnapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, snapshot, reopenedSnapshot)
+
+    // appends continue with the next record index
+    writeTestRecords(t, log, 5, 5)
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 10)
+    for i, record := range records {
+        assert.Equal(t, uint64(i), recordValue(t, record))
+    }
+}
+
+func TestLogConcurrentCursors(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    // read the log while it is being written, every record read must be
+    // complete
+    var group sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        group.Add(1)
+        go func() {
+            defer group.Done()
+
+            cursor, err := log.Cursor()
+            assert.Nil(t, err)
+            defer cursor.Close()
+
+            var i uint64
+            for i < 500 {
+                record, err := cursor.Next()
+                if err == common.ErrEndOfLog {
+                    runtime.Gosched()
+                    continue
+                }
+                assert.Nil(t, err)
+                assert.Equal(t, i, recordValue(t, record))
+                i++
+            }
+        }()
+    }
+
+    writeTestRecords(t, log, 0, 500)
+    group.Wait()
+}
+
+func TestLogClosed(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    assert.Equal(t, common.OPEN, log.State())
+    writeTestRecords(t, log, 0, 5)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    assert.Nil(t, log.Close())
+    assert.Equal(t, common.CLOSED, log.State())
+    assert.Equal(t, common.ErrLogClosed, log.Close())
+
+    // the log cannot be used after it is closed
+    _, err = log.Write(make([]byte, 8))
+    assert.Equal(t, common.ErrLogClosed, err)
+    _, err = log.Cursor()
+    assert.Equal(t, common.ErrLogClosed, err)
+    _, err = cursor.Next()
+    assert.Equal(t, common.ErrLogClosed, err)
+    assert.Equal(t, common.ErrLogClosed, log.Pipe(0, 1, ioutil.Discard))
+}
+
+func TestLogAppend(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    for i := uint64(0); i < 3; i++ {
+        index, err := log.Append([]byte{byte(i)})
+        assert.Nil(t, err)
+        assert.Equal(t, i, index)
+    }
+
+    // reserved flags are rejected
+    _, err := log.AppendWithFlags(common.BatchFlag|5, []byte{3})
+    assert.Equal(t, common.ErrReservedFlags, err)
+    index, err := log.AppendWithFlags(5, []byte{3})
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), index)
+
+    // the index can be used to find the record again
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    record, err := cursor.Seek(index)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte{3}, record.Data())
+    assert.Equal(t, uint32(5), record.Flags())
+}
+
+func TestLegacyFlags(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    // a file created before the flags were reserved
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    _, err = common.WriteFileHeader(common.LogFileSignature, common.NewFileHeader(VersionOne, common.BaseIndexFlag, 0), file)
+    assert.Nil(t, err)
+    log, err := Create(file, filename, DefaultConfig)
+    assert.Nil(t, err)
+
+    // every flag is a user flag
+    _, err = log.AppendWithFlags(common.BatchFlag|common.CompactedFlag, []byte{1})
+    assert.Nil(t, err)
+    _, err = log.AppendWithFlags(common.BatchFlag|common.KeyedFlag, []byte{2})
+    assert.Nil(t, err)
+
+    // features which need the reserved flags are not available
+    _, err = log.WriteBatch([][]byte{{3}, {4}})
+    assert.Equal(t, common.ErrReservedFlagsUnsupported, err)
+    _, err = log.AppendKeyed([]byte("key"), []byte{3})
+    assert.Equal(t, common.ErrReservedFlagsUnsupported, err)
+    assert.Equal(t, common.ErrReservedFlagsUnsupported, log.TruncateBefore(1))
+    assert.Nil(t, log.Close())
+
+    config := DefaultConfig
+    config.Compressor = common.NewFlateCompressor(1)
+    file, err = os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    _, err = Create(file, filename, config)
+    assert.Equal(t, common.ErrReservedFlagsUnsupported, err)
+
+    // the records are not read as an incomplete batch
+    file, err = os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    log, err = Create(file, filename, DefaultConfig)
+    assert.Nil(t, err)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+
+    records := readAllRecords(t, log)
+    if assert.Len(t, records, 2) {
+        assert.Equal(t, common.BatchFlag|common.CompactedFlag, records[0].Flags())
+        assert.Equal(t, []byte{1}, records[0].Data())
+        assert.Equal(t, common.BatchFlag|common.KeyedFlag, records[1].Flags())
+        assert.Equal(t, []byte{2}, records[1].Data())
+        assert.Nil(t, records[1].Key())
+    }
+}
@@ -0,0 +1,203 @@
+package v1
+
+import (
+    "io"
+    "os"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// Pipe copies the raw records starting at the record index `offset` into the
+// given writer. At most `limit` records are copied. The index is used to find
+// the byte range in the data file which is then copied in bulk, without
+// decoding any records. When the writer implements `io.ReaderFrom`, such as
+// a network connection, the copy can be done by the operating system.
+func (w *wal) Pipe(offset, limit uint64, writer io.Writer) error {
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    // find the end of the log and keep the files from being replaced
+    w.mutex.Lock()
+    size := w.index.Size()
+    logSize := w.logSize
+    w.files.RLock()
+    defer w.files.RUnlock()
+    w.mutex.Unlock()
+
+    // nothing to copy
+    if offset < w.index.Base() {
+        return common.ErrIndexOutOfRange
+    } else if offset >= size {
+        return common.ErrEndOfLog
+    } else if limit == 0 {
+        return nil
+    }
+
+    // open a read-only handle to the data file
+    data, err := os.Open(w.filename)
+    if err != nil {
+        return err
+    }
+    defer data.Close()
+
+    // find the start of the first record
+    first, err := w.index.Get(offset)
+    if err != nil {
+        return err
+    }
+    start := first.Offset()
+
+    // find the end of the last record
+    end := logSize
+    if limit < size-offset {
+        last, err := w.index.Get(offset + limit)
+        if err != nil {
+            return err
+        }
+        end = last.Offset()
+    }
+
+    // copy the raw records
+    if _, err = data.Seek(start, 0); err != nil {
+        return err
+    }
+    _, err = io.Copy(writer, io.LimitReader(data, end-start))
+    return err
+}
+
+// Ingest appends every record in a raw byte stream created by Pipe. The
+// stream must use the same record format as this log. Each record is
+// validated before it is appended and keeps its original flags and
+// timestamp. Records are assigned new indexes at the end of this log.
+//
+// Records of an atomic batch are appended together once the whole batch has
+// been read. The stream must come from a log which has the reserved record
+// flags if and only if this log has them, otherwise the record flags are
+// misread. A batch which is cut off at the end of the stream is not
+// appended or counted, so it can be piped again from its first record.
+//
+// Ingest stops at the first record which cannot be read or is invalid and
+// returns the number of records appended before it.
+func (w *wal) Ingest(reader io.Reader) (uint64, error) {
+    headerSize := w.format.HeaderSize
+
+    var count uint64
+    var batch [][]byte
+    for {
+
+        // read the record header, the stream may end between records
+        header := make([]byte, headerSize)
+        n, err := io.ReadFull(reader, header)
+        if n == 0 && err == io.EOF {
+            return count, nil
+        } else if err != nil {
+            return count, common.ErrReadLogRecord
+        }
+
+        // read the record data
+        size, _ := xbinary.LittleEndian.Uint32(header, 0)
+        if uint64(size) > uint64(maxStoredSize(w.maxRecordSize)) {
+            return count, common.ErrInvalidRecordSize
+        }
+        record := make([]byte, headerSize+int(size))
+        copy(record, header)
+        if _, err := io.ReadFull(reader, record[headerSize:]); err != nil {
+            return count, common.ErrReadLogRecord
+        }
+
+        // validate the record
+        if err := w.format.Verify(record); err != nil {
+            return count, err
+        }
+
+        // wait for the rest of the batch
+        batch = append(batch, record)
+        flags, _ := xbinary.LittleEndian.Uint32(record, 4)
+        if w.reserved && flags&common.BatchFlag != 0 {
+            continue
+        }
+
+        // append the records with their original flags and timestamps
+        if err := w.ingest(batch); err != nil {
+            return count, err
+        }
+        count += uint64(len(batch))
+        batch = batch[:0]
+    }
+}
+
+// ingest appends a batch of raw records with their original flags and
+// timestamps. With group commit the batch is committed and synced by the
+// committer like any other write.
+func (w *wal) ingest(batch [][]byte) error {
+    if w.commits != nil {
+        _, _, err := w.groupCommit(&commitRequest{records: batch, raw: true})
+        return err
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    }
+
+    if err := w.appendRaw(batch); err != nil {
+        return err
+    }
+    return w.flush()
+}
+
+// appendRaw encodes a batch of raw records into the write buffers with their
+// original flags and timestamps. Keyed records get a key index entry like
+// they do in `appendBatch`. If a record cannot be encoded none of the records
+// are kept.
+func (w *wal) appendRaw(batch [][]byte) error {
+    dataSize, indexSize, pending := w.dataBuffer.Len(), w.indexBuffer.Len(), len(w.pending)
+    index := w.index.Size() + uint64(pending)
+
+    var keysPending int
+    if w.keys != nil {
+        keysPending = len(w.keys.pending)
+    }
+
+    headerSize := w.format.HeaderSize
+    for i, record := range batch {
+        flags, _ := xbinary.LittleEndian.Uint32(record, 4)
+        nanos, _ := xbinary.LittleEndian.Int64(record, 8)
+
+        // the key is read from the decoded record data
+        var err error
+        if w.reserved && flags&common.KeyedFlag != 0 {
+            err = w.addRawKey(index+uint64(i), record)
+        }
+        if err == nil {
+            _, err = w.append(flags, nanos, record[headerSize:])
+        }
+        if err != nil {
+            w.dataBuffer.Truncate(dataSize)
+            w.indexBuffer.Truncate(indexSize)
+            w.pending = w.pending[:pending]
+            if w.keys != nil {
+                w.keys.rollback(keysPending)
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+// addRawKey buffers a key index entry for a raw keyed record which is about
+// to be appended at the given record index. Compressed and encrypted records
+// are decoded with the log's compressor and key provider to find the key.
+func (w *wal) addRawKey(index uint64, record []byte) error {
+    flags, _ := xbinary.LittleEndian.Uint32(record, 4)
+    key, _, err := decodeData(flags, record, record[w.format.HeaderSize:], w.maxRecordSize, w.compressor, w.keyProvider)
+    if err != nil {
+        return err
+    }
+    return w.addKey(index, key)
+}
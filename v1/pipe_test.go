@@ -0,0 +1,157 @@
+package v1
+
+import (
+    "bytes"
+    "compress/flate"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestPipe(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    writeTestRecords(t, log, 0, 5)
+
+    // pipe records 1 through 3
+    var buffer bytes.Buffer
+    assert.Nil(t, log.Pipe(1, 3, &buffer))
+    assert.Equal(t, 3*(LogRecordHeaderSize+8), buffer.Len())
+
+    // the limit is capped at the end of the log
+    buffer.Reset()
+    assert.Nil(t, log.Pipe(3, 10, &buffer))
+    assert.Equal(t, 2*(LogRecordHeaderSize+8), buffer.Len())
+
+    assert.Equal(t, common.ErrEndOfLog, log.Pipe(5, 1, &buffer))
+}
+
+func TestPipeIngest(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    source := openTestLog(t, dir, DefaultConfig)
+    defer source.Close()
+    writeTestRecords(t, source, 0, 5)
+
+    target := openTestLog(t, other, DefaultConfig)
+    defer target.Close()
+    writeTestRecords(t, target, 100, 1)
+
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(2, 3, &buffer))
+
+    count, err := target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), count)
+
+    // records keep their data and timestamps
+    sourceRecords := readAllRecords(t, source)
+    targetRecords := readAllRecords(t, target)
+    assert.Len(t, targetRecords, 4)
+    for i := 0; i < 3; i++ {
+        assert.Equal(t, sourceRecords[i+2].Data(), targetRecords[i+1].Data())
+        assert.Equal(t, sourceRecords[i+2].Time(), targetRecords[i+1].Time())
+    }
+}
+
+func TestIngestTruncatedStream(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    source := openTestLog(t, dir, DefaultConfig)
+    defer source.Close()
+    writeTestRecords(t, source, 0, 2)
+
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(0, 2, &buffer))
+    buffer.Truncate(buffer.Len() - 4)
+
+    target := openTestLog(t, other, DefaultConfig)
+    defer target.Close()
+
+    count, err := target.Ingest(&buffer)
+    assert.Equal(t, common.ErrReadLogRecord, err)
+    assert.Equal(t, uint64(1), count)
+}
+
+func TestIngestPartialBatch(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    source := openTestLog(t, dir, DefaultConfig)
+    defer source.Close()
+    writeTestRecords(t, source, 0, 1)
+    _, err := source.WriteBatch([][]byte{make([]byte, 8), make([]byte, 8)})
+    assert.Nil(t, err)
+
+    target := openTestLog(t, other, DefaultConfig)
+    defer target.Close()
+
+    // the stream ends in the middle of the batch
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(0, 2, &buffer))
+    count, err := target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1), count)
+    assert.Len(t, readAllRecords(t, target), 1)
+
+    // the batch is appended once it is piped from its first record
+    buffer.Reset()
+    assert.Nil(t, source.Pipe(count, 2, &buffer))
+    count, err = target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(2), count)
+    assert.Len(t, readAllRecords(t, target), 3)
+}
+
+func TestIngestKeyedRecords(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    other := createTestDir(t)
+    defer os.RemoveAll(other)
+
+    config := DefaultConfig
+    config.Compressor = common.NewFlateCompressor(flate.BestSpeed)
+    config.KeyProvider = common.NewKeyRing(1, map[uint32][]byte{1: make([]byte, 16)})
+    source := openTestLog(t, dir, config)
+    defer source.Close()
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+        _, err := source.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+
+    target := openTestLog(t, other, config)
+    _, err := target.Write([]byte("unkeyed"))
+    assert.Nil(t, err)
+
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(0, 3, &buffer))
+    count, err := target.Ingest(&buffer)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), count)
+
+    // the ingested records are in the key index
+    assertLatest(t, target, "a", "2")
+    assertLatest(t, target, "b", "1")
+    assert.Nil(t, target.Close())
+
+    target = openTestLog(t, other, config)
+    defer target.Close()
+    assertLatest(t, target, "a", "2")
+    stat, err := os.Stat(filepath.Join(other, "test.log.keys"))
+    assert.Nil(t, err)
+    assert.Equal(t, int64(3*KeyIndexEntrySize), stat.Size())
+}
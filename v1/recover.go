@@ -0,0 +1,251 @@
+package v1
+
+import (
+    "bufio"
+    "io"
+    "os"
+    "sync/atomic"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// Recover verifies the data file and the index file agree with each other.
+//
+// The data file is scanned from the start to find the last complete record.
+// Scanning stops at a record header which is truncated, zero-filled (left
+// behind by preallocation), has no timestamp, is larger than the maximum
+// record size, describes data past the end of the file or which fails to
+// decode. Everything after the last complete record is truncated.
+//
+// Records of an atomic batch are only kept if the batch is complete. If the
+// last scanned record has the `BatchFlag` set, the data file is truncated at
+// the first record of its batch. Files without the reserved record flags have
+// no batches.
+//
+// Index records are kept for as long as they match the scanned data records.
+// The first index record which does not match and all index records after it
+// are removed, then the missing index records are rebuilt from the data file.
+// If the index does not start at the same record index as the data file,
+// which happens when `TruncateBefore` is interrupted, the whole index is
+// rebuilt.
+func (w *wal) Recover() (common.RecoveryReport, error) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    var report common.RecoveryReport
+    if w.State() == common.CLOSED {
+        return report, common.ErrLogClosed
+    }
+
+    // open a read-only handle for scanning
+    data, err := os.Open(w.filename)
+    if err != nil {
+        return report, err
+    }
+    defer data.Close()
+
+    dataStat, err := data.Stat()
+    if err != nil {
+        return report, err
+    }
+
+    // index records can only be kept if the index starts at the same record
+    // as the data file
+    indexBase, indexSize := w.index.Base(), w.index.Size()
+    sameBase := indexBase == w.base
+
+    // seek past the file header
+    if _, err = data.Seek(w.headerSize, 0); err != nil {
+        return report, err
+    }
+    dataReader := bufio.NewReaderSize(data, 64*1024)
+
+    var (
+        offset        = w.headerSize
+        records       = w.base
+        matched       = w.base
+        lastWriteTime int64
+        rebuilt       []common.IndexRecord
+        headerSize    = w.format.HeaderSize
+        buffer        = make([]byte, headerSize)
+        indexValid    = sameBase
+
+        // the start of the last batch which has not been completed
+        batchOpen          bool
+        batchOffset        int64
+        batchRecords       uint64
+        batchLastWriteTime int64
+
+        // whether the scan stopped inside a partially written record
+        partial bool
+    )
+
+    for {
+
+        // read the record header, stop at a truncated header. Any written
+        // header byte means a record was started.
+        n, err := io.ReadFull(dataReader, buffer[:headerSize])
+        partial = !isZero(buffer[:n])
+        if err != nil {
+            break
+        }
+
+        // stop at an invalid size or a missing timestamp. Every record is
+        // written with a timestamp so a zero timestamp means the header is
+        // zero-filled or only partially written.
+        size, _ := xbinary.LittleEndian.Uint32(buffer, 0)
+        nanos, _ := xbinary.LittleEndian.Int64(buffer, 8)
+        if nanos == 0 || uint64(size) > uint64(maxStoredSize(w.maxRecordSize)) {
+            break
+        }
+
+        // stop if the record data extends past the end of the file
+        end := offset + int64(headerSize) + int64(size)
+        if end > dataStat.Size() {
+            break
+        }
+
+        // read record data and stop at a record which fails to decode
+        if len(buffer) < headerSize+int(size) {
+            buffer = append(buffer, make([]byte, headerSize+int(size)-len(buffer))...)
+        }
+        if _, err := io.ReadFull(dataReader, buffer[headerSize:headerSize+int(size)]); err != nil {
+            break
+        }
+        if _, err := w.format.Decode(records, buffer[:headerSize+int(size)]); err != nil {
+            break
+        }
+
+        // compare the record to the index
+        if indexValid && records < indexSize {
+            indexRecord, err := w.index.Get(records)
+            if err != nil {
+                return report, err
+            }
+
+            if indexRecord.Index() == records && indexRecord.Offset() == offset {
+                matched++
+            } else {
+                indexValid = false
+            }
+        } else {
+            indexValid = false
+        }
+
+        // records without a matching index record are rebuilt
+        if !indexValid {
+            rebuilt = append(rebuilt, common.NewIndexRecord(nanos, offset, records))
+        }
+
+        // remember where an incomplete batch starts
+        flags, _ := xbinary.LittleEndian.Uint32(buffer, 4)
+        batched := w.reserved && flags&common.BatchFlag != 0
+        if batched && !batchOpen {
+            batchOpen = true
+            batchOffset = offset
+            batchRecords = records
+            batchLastWriteTime = lastWriteTime
+        } else if !batched {
+            batchOpen = false
+        }
+
+        lastWriteTime = nanos
+        offset = end
+        records++
+        partial = false
+    }
+
+    // count the data records which are removed
+    if partial {
+        report.DataRecordsDropped++
+    }
+
+    // remove the records of an incomplete batch
+    if batchOpen {
+        report.DataRecordsDropped += records - batchRecords
+        offset = batchOffset
+        records = batchRecords
+        lastWriteTime = batchLastWriteTime
+        if matched > records {
+            matched = records
+        }
+        for len(rebuilt) > 0 && rebuilt[len(rebuilt)-1].Index() >= records {
+            rebuilt = rebuilt[:len(rebuilt)-1]
+        }
+    }
+
+    // truncate the data file after the last complete record
+    if dataStat.Size() > offset {
+        if err := w.file.Truncate(offset); err != nil {
+            return report, err
+        }
+        report.BytesTruncated = dataStat.Size() - offset
+    }
+
+    if sameBase {
+
+        // truncate the index file after the last matching index record
+        report.RecordsDropped = indexSize - matched
+        report.IndexBytesTruncated = int64(report.RecordsDropped) * IndexRecordSize
+        if matched < atomic.LoadUint64(&w.tail) {
+            atomic.StoreUint64(&w.tail, matched)
+        }
+        if err := w.index.Truncate(matched); err != nil {
+            return report, err
+        }
+
+        // rebuild the missing index records
+        indexRecordEncoder := NewIndexRecordEncoder(w.index)
+        for _, record := range rebuilt {
+            if _, err := indexRecordEncoder(record); err != nil {
+                return report, err
+            }
+        }
+    } else {
+
+        // replace the whole index
+        report.RecordsDropped = indexSize - indexBase
+        report.IndexBytesTruncated = int64(report.RecordsDropped) * IndexRecordSize
+        atomic.StoreUint64(&w.tail, w.base)
+        if err := w.replaceIndex(w.base, rebuilt); err != nil {
+            return report, err
+        }
+    }
+    report.RecordsRebuilt = uint64(len(rebuilt))
+
+    // publish the rebuilt records to cursors
+    atomic.StoreUint64(&w.tail, w.index.Size())
+    w.notifier.Notify()
+
+    // flush both files to disk
+    if err := w.file.Sync(); err != nil {
+        return report, err
+    }
+    if err := w.index.Sync(); err != nil {
+        return report, err
+    }
+
+    // recompute the running hash from the kept index records
+    if err := w.rehash(); err != nil {
+        return report, err
+    }
+
+    // update the log state to match the recovered files
+    w.logSize = offset
+    w.lastWriteTime = lastWriteTime
+    w.recoveryRequired = false
+
+    // the key index may refer to removed records
+    return report, w.rebuildKeys()
+}
+
+// isZero returns true if every byte of the buffer is zero.
+func isZero(buffer []byte) bool {
+    for _, b := range buffer {
+        if b != 0 {
+            return false
+        }
+    }
+    return true
+}
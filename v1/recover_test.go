@@ -0,0 +1,209 @@
+package v1
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// appendToFile appends raw bytes to the end of a file.
+func appendToFile(t *testing.T, filename string, data []byte) {
+    file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+    assert.Nil(t, err)
+    _, err = file.Write(data)
+    assert.Nil(t, err)
+    assert.Nil(t, file.Close())
+}
+
+// readAllRecords reads every record in the log with a new cursor.
+func readAllRecords(t *testing.T, log common.WriteAheadLog) []common.LogRecord {
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+
+    var records []common.LogRecord
+    record, err := cursor.Next()
+    for ; err == nil; record, err = cursor.Next() {
+        records = append(records, record)
+    }
+    assert.Equal(t, common.ErrEndOfLog, err)
+    return records
+}
+
+func TestRecoverCleanLog(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    assert.Nil(t, log.Close())
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+    assert.Len(t, readAllRecords(t, log), 5)
+}
+
+func TestRecoverTornRecord(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    assert.Nil(t, log.Close())
+
+    // half-written record header followed by preallocated space
+    appendToFile(t, filename, []byte{8, 0, 0, 0, 0, 0})
+    appendToFile(t, filename, make([]byte, 4096))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    // the log cannot be appended to until it is recovered
+    _, err := log.Write(make([]byte, 8))
+    assert.Equal(t, common.ErrRecoveryRequired, err)
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(4102), report.BytesTruncated)
+    assert.Equal(t, uint64(0), report.RecordsDropped)
+    assert.Equal(t, uint64(1), report.DataRecordsDropped)
+    assert.Equal(t, uint64(0), report.RecordsRebuilt)
+
+    // appends continue after the last complete record
+    writeTestRecords(t, log, 5, 1)
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 6)
+    for i, record := range records {
+        assert.Equal(t, uint64(i), recordValue(t, record))
+    }
+}
+
+func TestRecoverPreallocated(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 3)
+    assert.Nil(t, log.Close())
+
+    // zero-filled space after the last record is not a dropped record
+    appendToFile(t, filename, make([]byte, 4096))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(4096), report.BytesTruncated)
+    assert.Equal(t, uint64(0), report.DataRecordsDropped)
+    assert.Len(t, readAllRecords(t, log), 3)
+}
+
+func TestRecoverIndexPastData(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 3)
+    assert.Nil(t, log.Close())
+
+    // index record pointing past the end of the data file
+    var buffer bytes.Buffer
+    NewIndexRecordEncoder(&buffer)(common.NewIndexRecord(1, 4096, 3))
+    appendToFile(t, filename+".idx", buffer.Bytes())
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1), report.RecordsDropped)
+    assert.Equal(t, uint64(0), report.DataRecordsDropped)
+    assert.Equal(t, int64(IndexRecordSize), report.IndexBytesTruncated)
+    assert.Len(t, readAllRecords(t, log), 3)
+}
+
+func TestRecoverRebuildIndex(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // lose the last three index records
+    assert.Nil(t, os.Truncate(filename+".idx", IndexHeaderSize+2*IndexRecordSize))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), report.RecordsRebuilt)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 5)
+    for i, record := range records {
+        assert.Equal(t, uint64(i), recordValue(t, record))
+    }
+
+    // the rebuilt index hashes the same as the original one
+    recovered, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, snapshot.Hash(), recovered.Hash())
+}
+
+func TestRecoverIncompleteBatch(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 2)
+    before, err := log.Snapshot()
+    assert.Nil(t, err)
+
+    // every record except the last has the batch flag
+    n, err := log.WriteBatch([][]byte{make([]byte, 8), make([]byte, 8), make([]byte, 8)})
+    assert.Nil(t, err)
+    assert.Equal(t, 3*(8+LogRecordHeaderSize), n)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 5)
+    assert.Equal(t, common.BatchFlag, records[2].Flags())
+    assert.Equal(t, common.BatchFlag, records[3].Flags())
+    assert.Equal(t, uint32(0), records[4].Flags())
+    assert.Nil(t, log.Close())
+
+    // remove the last record of the batch
+    assert.Nil(t, os.Truncate(filename, LogHeaderSize+4*(8+LogRecordHeaderSize)))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    // the whole batch is removed
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(2*(8+LogRecordHeaderSize)), report.BytesTruncated)
+    assert.Equal(t, uint64(3), report.RecordsDropped)
+    assert.Equal(t, uint64(2), report.DataRecordsDropped)
+    assert.Len(t, readAllRecords(t, log), 2)
+
+    after, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, before, after)
+}
@@ -0,0 +1,528 @@
+package v1
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+    "time"
+
+    "github.com/blacklabeldata/m3"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// TruncateAfter removes every record after the given record index. The data
+// file and the index file are truncated and synced, and the running hash is
+// recomputed, so the log is in the same state as if the removed records had
+// never been written. Truncating after the last record does nothing.
+//
+// Cursors positioned after the given record wait for new records to be
+// appended at the freed record indexes.
+//
+// Truncating inside an atomic batch keeps the records of the batch up to the
+// given record. The `BatchFlag` of the given record is cleared first, so
+// recovery does not remove the kept records as an incomplete batch.
+func (w *wal) TruncateAfter(index uint64) error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    } else if w.recoveryRequired {
+        return common.ErrRecoveryRequired
+    }
+
+    // nothing after the record
+    size := w.index.Size()
+    if size == 0 || index >= size-1 {
+        return nil
+    } else if index < w.index.Base() {
+        return common.ErrIndexOutOfRange
+    }
+
+    // find the end of the kept records
+    last, err := w.index.Get(index)
+    if err != nil {
+        return err
+    }
+    first, err := w.index.Get(index + 1)
+    if err != nil {
+        return err
+    }
+    offset := first.Offset()
+
+    // end a batch at the kept record before the rest of the batch is removed.
+    // A crash in between leaves every record in place as two complete
+    // batches.
+    if w.reserved {
+        if err := w.endBatch(index, last.Offset()); err != nil {
+            return err
+        }
+    }
+
+    // hide the removed records from cursors
+    atomic.StoreUint64(&w.tail, index+1)
+
+    // truncate the data file before the index. If the index is not
+    // truncated the log needs recovery, which drops the index records past
+    // the end of the data file. Truncating the index first would let
+    // recovery rebuild the removed records from the data file.
+    if err := w.file.Truncate(offset); err != nil {
+        return err
+    }
+    if err := w.file.Sync(); err != nil {
+        w.recoveryRequired = true
+        return err
+    }
+    if err := w.index.Truncate(index + 1); err != nil {
+        w.recoveryRequired = true
+        return err
+    }
+    if err := w.index.Sync(); err != nil {
+        return err
+    }
+
+    // remove the key index entries of the removed records
+    if w.keys != nil {
+        if err := w.keys.load(index + 1); err != nil {
+            return err
+        }
+    }
+
+    // update the log state to match the truncated files
+    w.logSize = offset
+    w.lastWriteTime = last.Time()
+    return w.rehash()
+}
+
+// endBatch clears the `BatchFlag` of the record at the given record index and
+// offset, making it the last record of its batch. The record is encoded again
+// with the same timestamp and data and written over the old record, which
+// has the same size. Encrypted records are encrypted again because the flags
+// are authenticated with the data.
+func (w *wal) endBatch(index uint64, offset int64) error {
+    buffer, err := w.readRecord(offset)
+    if err != nil {
+        return err
+    }
+    flags, _ := xbinary.LittleEndian.Uint32(buffer, 4)
+    nanos, _ := xbinary.LittleEndian.Int64(buffer, 8)
+    if flags&common.BatchFlag == 0 {
+        return nil
+    }
+
+    flags &^= common.BatchFlag
+    data := buffer[w.format.HeaderSize:]
+    if flags&common.EncryptionFlag != 0 {
+        if w.keyProvider == nil {
+            return common.ErrKeyProviderRequired
+        }
+        data, err = common.DecryptRecord(w.keyProvider, buffer[:common.EncryptedHeaderSize], data)
+        if err != nil {
+            return err
+        }
+        data, flags, err = w.encrypt(data, flags&^common.EncryptionFlag, nanos)
+        if err != nil {
+            return err
+        }
+    }
+
+    // encode the record with the new flags
+    var record bytes.Buffer
+    encoder, err := w.format.NewEncoder(len(data), &record)
+    if err != nil {
+        return err
+    }
+    if _, err := encoder(index, flags, nanos, data); err != nil {
+        return err
+    } else if record.Len() != len(buffer) {
+        return common.ErrInvalidRecordSize
+    }
+
+    // the data file is opened for appending, so the record is written with
+    // a separate handle. Cursors are kept from reading the record until it
+    // has been written.
+    w.files.Lock()
+    defer w.files.Unlock()
+
+    file, err := os.OpenFile(w.filename, os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err := file.WriteAt(record.Bytes(), offset); err != nil {
+        file.Close()
+        w.recoveryRequired = true
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// rehash recomputes the running hash from the index records.
+func (w *wal) rehash() error {
+    w.hash.Reset()
+    return w.hashRecords(w.hashWriter, w.index.Size())
+}
+
+// hashRecords writes the index records from the first record up to the given
+// record index to a hash encoder.
+func (w *wal) hashRecords(encoder common.IndexRecordEncoder, size uint64) error {
+    for i := w.index.Base(); i < size; i++ {
+        record, err := w.index.Get(i)
+        if err != nil {
+            return err
+        }
+        encoder(record)
+    }
+    return nil
+}
+
+// TruncateBefore removes every record before the given record index. The
+// remaining records are copied into new data and index files which replace
+// the old ones. The new files have the `BaseIndexFlag` set and store the
+// given record index in their headers, so the remaining records keep their
+// record indexes. Truncating before the first record does nothing.
+// `ErrIndexOutOfRange` is returned if the record index is past the end of the
+// log.
+//
+// Cursors positioned before the given record continue at the given record.
+// The key index is rebuilt from the remaining records. Files without the
+// reserved record flags cannot store a base record index.
+func (w *wal) TruncateBefore(index uint64) error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return common.ErrLogClosed
+    } else if w.recoveryRequired {
+        return common.ErrRecoveryRequired
+    } else if !w.reserved {
+        return common.ErrReservedFlagsUnsupported
+    }
+    return w.truncateBefore(index)
+}
+
+// Reclaim removes the records at the start of the log which have expired
+// according to the log's TTL and returns the number of records removed. The
+// records are removed with `TruncateBefore`, so the remaining records keep
+// their record indexes. Files without the reserved record flags cannot remove
+// records from their start and return `ErrReservedFlagsUnsupported` when the
+// log has a TTL.
+func (w *wal) Reclaim() (int, error) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return 0, common.ErrLogClosed
+    } else if w.recoveryRequired {
+        return 0, common.ErrRecoveryRequired
+    }
+
+    ttl := w.index.Header().Expiration()
+    if ttl <= 0 {
+        return 0, nil
+    } else if !w.reserved {
+        return 0, common.ErrReservedFlagsUnsupported
+    }
+
+    // records written before the cutoff have expired
+    base := w.index.Base()
+    index, err := searchTime(w.index, time.Now().UnixNano()-ttl)
+    if err != nil || index == base {
+        return 0, err
+    }
+    return int(index - base), w.truncateBefore(index)
+}
+
+// truncateBefore removes every record before the given record index. The
+// mutex must be held.
+func (w *wal) truncateBefore(index uint64) error {
+    base, size := w.index.Base(), w.index.Size()
+    if index <= base {
+        return nil
+    } else if index > size {
+        return common.ErrIndexOutOfRange
+    }
+
+    // find the start of the kept records
+    start := w.logSize
+    if index < size {
+        first, err := w.index.Get(index)
+        if err != nil {
+            return err
+        }
+        start = first.Offset()
+    }
+    headerSize := int64(common.LogHeaderSize + 8)
+
+    // copy the kept records into a new data file
+    header, err := common.ReadFileHeader(io.NewSectionReader(w.file, 0, common.LogHeaderSize))
+    if err != nil {
+        return err
+    }
+    err = w.rewrite(w.filename, common.LogFileSignature, header, index, func(writer io.Writer) error {
+        _, err := io.Copy(writer, io.NewSectionReader(w.file, start, w.logSize-start))
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    // copy the kept index records into a new index file, moving the offsets
+    // to the new data file
+    err = w.rewrite(w.filename+".idx", common.IndexFileSignature, w.index.Header(), index, func(writer io.Writer) error {
+        encoder := NewIndexRecordEncoder(writer)
+        for i := index; i < size; i++ {
+            record, err := w.index.Get(i)
+            if err != nil {
+                return err
+            }
+            _, err = encoder(common.NewIndexRecord(record.Time(), record.Offset()-start+headerSize, i))
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        os.Remove(w.filename + ".tmp")
+        return err
+    }
+
+    if err := w.replaceFiles(); err != nil {
+        return err
+    }
+
+    // update the log state to match the new files
+    w.base = index
+    w.headerSize = headerSize
+    w.logSize = headerSize + w.logSize - start
+    if err := w.rehash(); err != nil {
+        return err
+    }
+
+    // drop the key index entries of the removed records
+    return w.rebuildKeys()
+}
+
+// rewrite writes a new file next to the given file, which can be renamed over
+// it. The file header has the `BaseIndexFlag` set and is followed by the base
+// record index and the contents written by the body. The new file is synced
+// before it is closed.
+func (w *wal) rewrite(filename string, signature []byte, header common.FileHeader, base uint64, body func(writer io.Writer) error) error {
+    file, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+
+    // write the header and the contents
+    writer := bufio.NewWriter(file)
+    err = writeBaseIndexHeader(writer, signature, header, base)
+    if err == nil {
+        err = body(writer)
+    }
+    if err == nil {
+        err = writer.Flush()
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    if err != nil {
+        file.Close()
+        os.Remove(filename + ".tmp")
+        return err
+    }
+    return file.Close()
+}
+
+// replaceFiles moves the new data and index files written by rewrite over the
+// old files and reopens them. The two renames are not atomic together, so a
+// swap marker file is written first. If the log crashes before the marker is
+// removed, `finishSwap` completes the renames when the log is opened again.
+// If the index file cannot be moved the log must be recovered, which rebuilds
+// the index from the new data file.
+func (w *wal) replaceFiles() error {
+    w.files.Lock()
+    defer w.files.Unlock()
+
+    if err := writeSwapMarker(w.filename); err != nil {
+        return err
+    }
+    if err := os.Rename(w.filename+".tmp", w.filename); err != nil {
+        os.Remove(w.filename + ".swap")
+        return err
+    }
+    if err := os.Rename(w.filename+".idx.tmp", w.filename+".idx"); err != nil {
+        w.recoveryRequired = true
+        return err
+    }
+    if err := syncDir(w.filename); err != nil {
+        return err
+    }
+    if err := os.Remove(w.filename + ".swap"); err != nil {
+        return err
+    }
+    return w.reopen()
+}
+
+// writeSwapMarker creates the swap marker of a log, showing that both new
+// files are complete and are being moved over the old files.
+func writeSwapMarker(filename string) error {
+    marker, err := os.OpenFile(filename+".swap", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    if err := marker.Sync(); err != nil {
+        marker.Close()
+        return err
+    }
+    if err := marker.Close(); err != nil {
+        return err
+    }
+    return syncDir(filename)
+}
+
+// finishSwap cleans up after a file swap which was interrupted by a crash.
+// If the swap marker exists both new files were complete, so the renames
+// which did not happen are done. Otherwise the new files may be incomplete
+// and are removed, leaving the old files in place. It reports whether the
+// data file was replaced.
+func finishSwap(filename string) (bool, error) {
+    _, err := os.Stat(filename + ".swap")
+    if os.IsNotExist(err) {
+        for _, name := range []string{filename + ".tmp", filename + ".idx.tmp"} {
+            if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+                return false, err
+            }
+        }
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+
+    var replaced bool
+    if err := os.Rename(filename+".tmp", filename); err == nil {
+        replaced = true
+    } else if !os.IsNotExist(err) {
+        return false, err
+    }
+    if err := os.Rename(filename+".idx.tmp", filename+".idx"); err != nil && !os.IsNotExist(err) {
+        return replaced, err
+    }
+    if err := syncDir(filename); err != nil {
+        return replaced, err
+    }
+    return replaced, os.Remove(filename + ".swap")
+}
+
+// syncDir flushes the directory containing the given file to permanent
+// storage, so files created, renamed or removed in it are durable.
+func syncDir(filename string) error {
+    dir, err := os.Open(filepath.Dir(filename))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return dir.Sync()
+}
+
+// reopen replaces the handles of the data and index files after the files
+// have been replaced. Cursors reopen their data file handles the next time
+// they read a record.
+func (w *wal) reopen() error {
+    header := w.index.Header()
+
+    // reopen the data file
+    w.logWriter.Close()
+    file, err := os.OpenFile(w.filename, os.O_APPEND|os.O_RDWR, 0600)
+    if err != nil {
+        return err
+    }
+    w.file = file
+    w.logWriter = m3.NewFileWriter(file, w.strategy)
+
+    // reopen the index file
+    w.index.Close()
+    idxFile, err := os.OpenFile(w.filename+".idx", os.O_APPEND|os.O_RDWR, 0600)
+    if err != nil {
+        return err
+    }
+    index, err := VersionOneIndexFactory(idxFile, header.Version(), header.Flags(), header.Expiration())
+    if err != nil {
+        return err
+    }
+    w.index = index
+    w.generation++
+    return nil
+}
+
+// replaceIndex replaces the index file with one containing the given index
+// records, starting at the base record index.
+func (w *wal) replaceIndex(base uint64, records []common.IndexRecord) error {
+    err := w.rewrite(w.filename+".idx", common.IndexFileSignature, w.index.Header(), base, func(writer io.Writer) error {
+        encoder := NewIndexRecordEncoder(writer)
+        for _, record := range records {
+            if _, err := encoder(record); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    w.files.Lock()
+    defer w.files.Unlock()
+
+    if err := os.Rename(w.filename+".idx.tmp", w.filename+".idx"); err != nil {
+        return err
+    }
+
+    // reopen the index file
+    header := w.index.Header()
+    w.index.Close()
+    idxFile, err := os.OpenFile(w.filename+".idx", os.O_APPEND|os.O_RDWR, 0600)
+    if err != nil {
+        return err
+    }
+    w.index, err = VersionOneIndexFactory(idxFile, header.Version(), header.Flags(), header.Expiration())
+    return err
+}
+
+// readBaseIndex reads the record index following the header of a log or
+// index file with the given header. Files without the `BaseIndexFlag`, or
+// without the reserved record flags, start at record index 0. The size of the
+// header including the base index is returned.
+func readBaseIndex(file io.ReaderAt, header common.FileHeader) (uint64, int64, error) {
+    if header.Version()&common.ReservedFlagsFeature == 0 || header.Flags()&common.BaseIndexFlag == 0 {
+        return 0, common.LogHeaderSize, nil
+    }
+
+    buffer := make([]byte, 8)
+    if n, _ := file.ReadAt(buffer, common.LogHeaderSize); n < len(buffer) {
+        return 0, 0, common.ErrReadFileHeader
+    }
+    base, _ := xbinary.LittleEndian.Uint64(buffer, 0)
+    return base, common.LogHeaderSize + 8, nil
+}
+
+// writeBaseIndexHeader writes a file header with the `BaseIndexFlag` set,
+// followed by the base record index.
+func writeBaseIndexHeader(writer io.Writer, signature []byte, header common.FileHeader, base uint64) error {
+    header = common.NewFileHeader(header.Version(), header.Flags()|common.BaseIndexFlag, header.Expiration())
+    if _, err := common.WriteFileHeader(signature, header, writer); err != nil {
+        return err
+    }
+
+    buffer := make([]byte, 8)
+    xbinary.LittleEndian.PutUint64(buffer, 0, base)
+    _, err := writer.Write(buffer)
+    return err
+}
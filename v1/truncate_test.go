@@ -0,0 +1,302 @@
+package v1
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestTruncateAfter(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    writeTestRecords(t, log, 5, 5)
+
+    // the log is the same as before the removed records were written
+    assert.Nil(t, log.TruncateAfter(4))
+    truncated, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, snapshot, truncated)
+    truncatedMeta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, meta, truncatedMeta)
+
+    // truncating after the last record does nothing
+    assert.Nil(t, log.TruncateAfter(4))
+    assert.Nil(t, log.TruncateAfter(100))
+    assert.Len(t, readAllRecords(t, log), 5)
+
+    // the removed record indexes are reused
+    index, err := log.Append(make([]byte, 8))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(5), index)
+    assert.Nil(t, log.Close())
+
+    // the truncated log does not need recovery
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 6)
+    for i := 0; i < 5; i++ {
+        assert.Equal(t, uint64(i), recordValue(t, records[i]))
+    }
+}
+
+func TestTruncateAfterInsideBatch(t *testing.T) {
+    encrypted := DefaultConfig
+    encrypted.KeyProvider = common.NewKeyRing(1, map[uint32][]byte{1: make([]byte, 16)})
+
+    for _, config := range []common.Config{DefaultConfig, encrypted} {
+        dir := createTestDir(t)
+        defer os.RemoveAll(dir)
+
+        log := openTestLog(t, dir, config)
+        _, err := log.Write([]byte("a"))
+        assert.Nil(t, err)
+        _, err = log.Write([]byte("b"))
+        assert.Nil(t, err)
+        _, err = log.WriteBatch([][]byte{[]byte("c"), []byte("d"), []byte("e")})
+        assert.Nil(t, err)
+
+        // the kept records of the batch survive recovery
+        assert.Nil(t, log.TruncateAfter(3))
+        assert.Nil(t, log.Close())
+
+        log = openTestLog(t, dir, config)
+        report, err := log.Recover()
+        assert.Nil(t, err)
+        assert.Equal(t, common.RecoveryReport{}, report)
+
+        records := readAllRecords(t, log)
+        if assert.Len(t, records, 4) {
+            assert.Equal(t, []byte("d"), records[3].Data())
+            assert.Equal(t, uint32(0), records[3].Flags()&common.BatchFlag)
+            assert.Equal(t, common.BatchFlag, records[2].Flags()&common.BatchFlag)
+        }
+        assert.Nil(t, log.Close())
+    }
+}
+
+func TestRecoverInterruptedTruncateAfter(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 5)
+    index, err := ioutil.ReadFile(filename + ".idx")
+    assert.Nil(t, err)
+
+    assert.Nil(t, log.TruncateAfter(2))
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // the data file was truncated but the index file was not
+    assert.Nil(t, ioutil.WriteFile(filename+".idx", index, 0600))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    _, err = log.Write(make([]byte, 8))
+    assert.Equal(t, common.ErrRecoveryRequired, err)
+
+    // the removed records do not come back
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(2), report.RecordsDropped)
+    assert.Equal(t, uint64(0), report.RecordsRebuilt)
+
+    recovered, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, snapshot, recovered)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 3)
+    for i, record := range records {
+        assert.Equal(t, uint64(i), recordValue(t, record))
+    }
+}
+
+func TestTruncateBefore(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 10)
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    defer cursor.Close()
+    _, err = cursor.Next()
+    assert.Nil(t, err)
+
+    // truncating before the first record does nothing
+    assert.Nil(t, log.TruncateBefore(0))
+    assert.Equal(t, common.ErrIndexOutOfRange, log.TruncateBefore(11))
+
+    assert.Nil(t, log.TruncateBefore(3))
+    meta, err := log.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(LogHeaderSize+8+7*(8+LogRecordHeaderSize)), meta.Size)
+    assert.Equal(t, uint64(10), meta.Records)
+
+    // open cursors continue at the first remaining record
+    record, err := cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+
+    // remaining records keep their record indexes
+    record, err = cursor.Seek(7)
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(7), recordValue(t, record))
+    assert.Equal(t, common.ErrIndexOutOfRange, log.Pipe(2, 1, ioutil.Discard))
+
+    index, err := log.Append(make([]byte, 8))
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(10), index)
+    assert.Nil(t, log.Close())
+
+    // the truncated log does not need recovery
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, common.RecoveryReport{}, report)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 8)
+    for i := 0; i < 7; i++ {
+        assert.Equal(t, uint64(i+3), recordValue(t, records[i]))
+    }
+}
+
+func TestRecoverInterruptedTruncateBefore(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir, DefaultConfig)
+    writeTestRecords(t, log, 0, 10)
+    index, err := ioutil.ReadFile(filename + ".idx")
+    assert.Nil(t, err)
+
+    assert.Nil(t, log.TruncateBefore(3))
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Nil(t, log.Close())
+
+    // the data file was replaced but the index file was not
+    assert.Nil(t, ioutil.WriteFile(filename+".idx", index, 0600))
+
+    log = openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    _, err = log.Write(make([]byte, 8))
+    assert.Equal(t, common.ErrRecoveryRequired, err)
+
+    // the index is rebuilt from the data file
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(10), report.RecordsDropped)
+    assert.Equal(t, uint64(7), report.RecordsRebuilt)
+
+    recovered, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Equal(t, snapshot, recovered)
+
+    records := readAllRecords(t, log)
+    assert.Len(t, records, 7)
+    for i, record := range records {
+        assert.Equal(t, uint64(i+3), recordValue(t, record))
+    }
+}
+
+func TestTruncateBeforeKeys(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+    for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}} {
+        _, err := log.AppendKeyed([]byte(kv[0]), []byte(kv[1]))
+        assert.Nil(t, err)
+    }
+
+    // only the entries of the remaining records are kept
+    assert.Nil(t, log.TruncateBefore(2))
+    stat, err := os.Stat(filepath.Join(dir, "test.log.keys"))
+    assert.Nil(t, err)
+    assert.Equal(t, int64(2*KeyIndexEntrySize), stat.Size())
+
+    assertLatest(t, log, "a", "2")
+    assertLatest(t, log, "c", "1")
+    _, err = log.GetLatest([]byte("b"))
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestReclaim(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    config := DefaultConfig
+    config.TimeToLive = int64(time.Hour)
+    log := openTestLog(t, dir, config)
+    defer log.Close()
+    ingestExpired(t, log, 0, 3)
+    writeTestRecords(t, log, 3, 2)
+
+    // the expired prefix is removed and the other records keep their indexes
+    removed, err := log.(common.Reclaimer).Reclaim()
+    assert.Nil(t, err)
+    assert.Equal(t, 3, removed)
+    cursor, err := log.Cursor(common.WithExpired())
+    assert.Nil(t, err)
+    record, err := cursor.Next()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), recordValue(t, record))
+    assert.Equal(t, uint64(4), cursor.Position())
+    assert.Nil(t, cursor.Close())
+
+    removed, err = log.(common.Reclaimer).Reclaim()
+    assert.Nil(t, err)
+    assert.Equal(t, 0, removed)
+}
+
+func TestReclaimLegacy(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    // files without the reserved record flags cannot remove expired records
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    _, err = common.WriteFileHeader(common.LogFileSignature, common.NewFileHeader(VersionOne, 0, int64(time.Hour)), file)
+    assert.Nil(t, err)
+    config := DefaultConfig
+    config.TimeToLive = int64(time.Hour)
+    log, err := Create(file, filename, config)
+    assert.Nil(t, err)
+    defer log.Close()
+
+    ingestExpired(t, log, 0, 1)
+    _, err = log.(common.Reclaimer).Reclaim()
+    assert.Equal(t, common.ErrReservedFlagsUnsupported, err)
+}
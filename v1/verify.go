@@ -0,0 +1,48 @@
+package v1
+
+import (
+    "github.com/OneOfOne/xxhash"
+    "github.com/blacklabeldata/wallaby/common"
+)
+
+// Verify recomputes the hash of the index records before the snapshot's size
+// and compares it with the snapshot hash. `ErrSnapshotMismatch` is returned if
+// the log has fewer records than the snapshot or if the hashes differ, which
+// means records were changed or the log diverged from the one the snapshot was
+// taken of. Records removed with `TruncateBefore` are no longer part of the
+// hash, so older snapshots do not match after it.
+func (w *wal) Verify(snapshot common.Snapshot) error {
+    if snapshot.Size() < 0 {
+        return common.ErrSnapshotMismatch
+    }
+
+    hash, err := w.SnapshotHash(uint64(snapshot.Size()))
+    if err == common.ErrIndexOutOfRange {
+        return common.ErrSnapshotMismatch
+    } else if err != nil {
+        return err
+    } else if hash != snapshot.Hash() {
+        return common.ErrSnapshotMismatch
+    }
+    return nil
+}
+
+// SnapshotHash returns the hash a snapshot would have had when the log ended
+// at the given record index. `ErrIndexOutOfRange` is returned if the record
+// index is before the first record or past the end of the log.
+func (w *wal) SnapshotHash(size uint64) (uint64, error) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.State() == common.CLOSED {
+        return 0, common.ErrLogClosed
+    } else if size < w.index.Base() || size > w.index.Size() {
+        return 0, common.ErrIndexOutOfRange
+    }
+
+    hash := xxhash.New64()
+    if err := w.hashRecords(NewIndexRecordEncoder(hash), size); err != nil {
+        return 0, err
+    }
+    return hash.Sum64(), nil
+}
@@ -0,0 +1,42 @@
+package v1
+
+import (
+    "os"
+    "testing"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+    dir := createTestDir(t)
+    defer os.RemoveAll(dir)
+
+    log := openTestLog(t, dir, DefaultConfig)
+    defer log.Close()
+
+    writeTestRecords(t, log, 0, 5)
+    snapshot, err := log.Snapshot()
+    assert.Nil(t, err)
+
+    // later records do not change the snapshot
+    writeTestRecords(t, log, 5, 3)
+    assert.Nil(t, log.Verify(snapshot))
+    current, err := log.Snapshot()
+    assert.Nil(t, err)
+    assert.Nil(t, log.Verify(current))
+
+    // the log is shorter than the snapshot
+    assert.Nil(t, log.TruncateAfter(4))
+    assert.Nil(t, log.Verify(snapshot))
+    assert.Equal(t, common.ErrSnapshotMismatch, log.Verify(current))
+
+    // a replica with different records
+    replicaDir := createTestDir(t)
+    defer os.RemoveAll(replicaDir)
+
+    replica := openTestLog(t, replicaDir, DefaultConfig)
+    defer replica.Close()
+    writeTestRecords(t, replica, 0, 5)
+    assert.Equal(t, common.ErrSnapshotMismatch, replica.Verify(snapshot))
+}
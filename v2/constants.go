@@ -0,0 +1,17 @@
+package v2
+
+// ## **Log Constants**
+
+const (
+
+    // VersionTwo is an integer denoting the second version
+    VersionTwo = 2
+
+    // LogRecordHeaderSize is the size of the log record headers. Version 2
+    // record headers add the record index and a CRC32-C checksum to the
+    // version 1 record header.
+    LogRecordHeaderSize = 28
+
+    // MaxRecordSize is the maximum size a record can be for version 2
+    MaxRecordSize = 0xffffffff
+)
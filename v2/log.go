@@ -0,0 +1,250 @@
+package v2
+
+import (
+    "hash/crc32"
+    "io"
+    "os"
+
+    "github.com/blacklabeldata/m3"
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/blacklabeldata/wallaby/v1"
+    "github.com/blacklabeldata/xbinary"
+)
+
+// castagnoli is the CRC32-C table used for record checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DefaultConfig can be used for sensible default log configuration.
+var DefaultConfig common.Config = common.Config{
+    FileMode:           0600,
+    MaxRecordSize:      common.DefaultMaxRecordSize,
+    Flags:              common.DefaultRecordFlags,
+    Version:            VersionTwo,
+    Truncate:           false,
+    TimeToLive:         0,
+    Strategy:           m3.NoSyncOnWrite,
+    TombstoneRetention: common.DefaultTombstoneRetention,
+}
+
+// VersionTwoFormat is the record format for version 2 log files. The index
+// files are the same as version 1.
+var VersionTwoFormat = v1.RecordFormat{
+    HeaderSize: LogRecordHeaderSize,
+    NewEncoder: NewLogRecordEncoder,
+    Decode:     DecodeLogRecord,
+    Verify:     VerifyLogRecord,
+}
+
+// NewLogRecordEncoder creates a new LogRecordEncoder which validates records
+// are smaller than the given maxSize. Each record header contains the size,
+// flags, timestamp and index of the record followed by a CRC32-C checksum of
+// the header and the record data.
+//
+// ```
+// 4-byte size
+// 4-byte flags
+// 8-byte time
+// 8-byte index
+// 4-byte crc32-c
+// data
+// ```
+func NewLogRecordEncoder(maxSize int, writer io.Writer) (common.LogRecordEncoder, error) {
+
+    // v2 log records can't be larger than 4gb
+    if maxSize > MaxRecordSize {
+        return nil, common.ErrRecordFactorySize
+    }
+
+    // create buffer
+    buffer := make([]byte, maxSize+LogRecordHeaderSize)
+    return func(index uint64, flags uint32, timestamp int64, data []byte) (int, error) {
+
+        // validate record size
+        if len(data) > maxSize {
+            return 0, common.ErrRecordTooLarge
+        }
+
+        // write uint32 size
+        xbinary.LittleEndian.PutUint32(buffer, 0, uint32(len(data)))
+
+        // write uint32 flags
+        xbinary.LittleEndian.PutUint32(buffer, 4, flags)
+
+        // write int64 timestamp
+        xbinary.LittleEndian.PutInt64(buffer, 8, timestamp)
+
+        // write uint64 index
+        xbinary.LittleEndian.PutUint64(buffer, 16, index)
+
+        copy(buffer[LogRecordHeaderSize:len(data)+LogRecordHeaderSize], data[:])
+
+        // write uint32 checksum
+        xbinary.LittleEndian.PutUint32(buffer, 24, checksum(buffer[:len(data)+LogRecordHeaderSize]))
+
+        return writer.Write(buffer[:len(data)+LogRecordHeaderSize])
+    }, nil
+}
+
+// NewLogRecordDecoder creates a LogRecordDecoder which reads records from the
+// given reader. A `*common.CorruptRecordError` is returned if a record does
+// not match its checksum.
+func NewLogRecordDecoder(maxSize int, reader io.Reader) common.LogRecordDecoder {
+
+    buffer := make([]byte, maxSize+LogRecordHeaderSize)
+    return func() (common.LogRecord, error) {
+        _, err := io.ReadFull(reader, buffer[:LogRecordHeaderSize])
+        if err != nil {
+            return nil, common.ErrReadLogRecord
+        }
+
+        size, err := xbinary.LittleEndian.Uint32(buffer, 0)
+        if err != nil {
+            return nil, common.ErrReadLogRecord
+        } else if size > uint32(maxSize) {
+            return nil, common.ErrInvalidRecordSize
+        }
+
+        _, err = io.ReadFull(reader, buffer[LogRecordHeaderSize:size+LogRecordHeaderSize])
+        if err != nil {
+            return nil, common.ErrReadLogRecord
+        }
+
+        record := &RawLogRecord{buffer[:size+LogRecordHeaderSize]}
+        if err := record.Verify(); err != nil {
+            return nil, err
+        }
+        return record, nil
+    }
+}
+
+// DecodeLogRecord validates a record read from the data file. The buffer
+// contains the record header followed by the record data. A
+// `*common.CorruptRecordError` is returned if the record does not match its
+// checksum and `common.ErrRecordIndexMismatch` if the record is not the one
+// expected at the given index.
+func DecodeLogRecord(index uint64, buffer []byte) (common.LogRecord, error) {
+    if len(buffer) < LogRecordHeaderSize {
+        return nil, common.ErrReadLogRecord
+    }
+
+    record := &RawLogRecord{buffer}
+    if err := record.Verify(); err != nil {
+        return nil, err
+    } else if record.Index() != index {
+        return nil, common.ErrRecordIndexMismatch
+    }
+    return record, nil
+}
+
+// VerifyLogRecord validates the checksum of a record without checking its
+// index. A `*common.CorruptRecordError` is returned if the record does not
+// match its checksum.
+func VerifyLogRecord(buffer []byte) error {
+    if len(buffer) < LogRecordHeaderSize {
+        return common.ErrReadLogRecord
+    }
+    return (&RawLogRecord{buffer}).Verify()
+}
+
+// checksum computes the CRC32-C of a record header and data, skipping the
+// checksum field itself.
+func checksum(buffer []byte) uint32 {
+    crc := crc32.Update(0, castagnoli, buffer[:24])
+    return crc32.Update(crc, castagnoli, buffer[LogRecordHeaderSize:])
+}
+
+// RawLogRecord implements the bare LogRecord interface.
+type RawLogRecord struct {
+    buffer []byte
+}
+
+// Size returns the length of the record payload
+func (i *RawLogRecord) Size() uint32 {
+    size, err := xbinary.LittleEndian.Uint32(i.buffer, 0)
+    if err != nil {
+        size = 0
+    }
+
+    return size
+}
+
+// StoredSize is the size of the record payload in the data file
+func (i *RawLogRecord) StoredSize() uint32 {
+    return i.Size()
+}
+
+// Key is nil, keys are decoded by the cursor
+func (i *RawLogRecord) Key() []byte {
+    return nil
+}
+
+// Flags returns the boolean flags for the record
+func (i *RawLogRecord) Flags() uint32 {
+    flags, err := xbinary.LittleEndian.Uint32(i.buffer, 4)
+    if err != nil {
+        flags = 0
+    }
+
+    return flags
+}
+
+// Time is the record nanoseconds from epoch
+func (i *RawLogRecord) Time() int64 {
+    nanos, err := xbinary.LittleEndian.Int64(i.buffer, 8)
+    if err != nil {
+        nanos = 0
+    }
+
+    return nanos
+}
+
+// Index is the record's numerical id.
+func (i *RawLogRecord) Index() uint64 {
+    index, err := xbinary.LittleEndian.Uint64(i.buffer, 16)
+    if err != nil {
+        index = 0
+    }
+
+    return index
+}
+
+// Checksum is the CRC32-C stored in the record header.
+func (i *RawLogRecord) Checksum() uint32 {
+    crc, err := xbinary.LittleEndian.Uint32(i.buffer, 24)
+    if err != nil {
+        crc = 0
+    }
+
+    return crc
+}
+
+// Verify compares the stored checksum with the checksum of the record header
+// and data. A `*common.CorruptRecordError` is returned if they differ.
+func (i *RawLogRecord) Verify() error {
+    if actual := checksum(i.buffer); actual != i.Checksum() {
+        return &common.CorruptRecordError{Index: i.Index(), Expected: i.Checksum(), Actual: actual}
+    }
+    return nil
+}
+
+// Data is the record payload
+func (i *RawLogRecord) Data() []byte {
+    return i.buffer[LogRecordHeaderSize:]
+}
+
+// IsExpired is a helper function for the index record which returns `true` if the given time is beyond the expiration time. The expiration time is calculated as written time + TTL.
+func (i *RawLogRecord) IsExpired(now, ttl int64) bool {
+    if ttl <= 0 {
+        return false
+    }
+    return now > i.Time()+ttl
+}
+
+// ### **Creates a v2 log file**
+// Version 2 logs use the version 1 index and log implementation with
+// checksummed records.
+
+// ###### *Implementation*
+func Create(file *os.File, filename string, config common.Config) (common.WriteAheadLog, error) {
+    return v1.CreateWithFormat(file, filename, config, VersionTwoFormat)
+}
@@ -0,0 +1,155 @@
+package v2
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/blacklabeldata/wallaby/common"
+    "github.com/stretchr/testify/assert"
+)
+
+// openTestLog opens a v2 log file in the given directory the same way
+// `wallaby.Create` does, writing the file header for new files.
+func openTestLog(t *testing.T, dir string) common.WriteAheadLog {
+    filename := filepath.Join(dir, "test.log")
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+    assert.Nil(t, err)
+
+    stat, err := file.Stat()
+    assert.Nil(t, err)
+    if stat.Size() < common.LogHeaderSize {
+        header := common.NewFileHeader(VersionTwo|common.ReservedFlagsFeature, 0, 0)
+        _, err = common.WriteFileHeader(common.LogFileSignature, header, file)
+        assert.Nil(t, err)
+    }
+
+    log, err := Create(file, filename, DefaultConfig)
+    assert.Nil(t, err)
+    return log
+}
+
+func TestLogRecordEncodeDecode(t *testing.T) {
+    var buffer bytes.Buffer
+    encoder, err := NewLogRecordEncoder(1024, &buffer)
+    assert.Nil(t, err)
+
+    now := time.Now().UnixNano()
+    n, err := encoder(7, 3, now, []byte("hello"))
+    assert.Nil(t, err)
+    assert.Equal(t, LogRecordHeaderSize+5, n)
+
+    decoder := NewLogRecordDecoder(1024, bytes.NewReader(buffer.Bytes()))
+    record, err := decoder()
+    assert.Nil(t, err)
+    assert.Equal(t, uint32(5), record.Size())
+    assert.Equal(t, uint32(3), record.Flags())
+    assert.Equal(t, now, record.Time())
+    assert.Equal(t, uint64(7), record.(*RawLogRecord).Index())
+    assert.Equal(t, []byte("hello"), record.Data())
+}
+
+func TestLogRecordDecodeCorrupt(t *testing.T) {
+    var buffer bytes.Buffer
+    encoder, err := NewLogRecordEncoder(1024, &buffer)
+    assert.Nil(t, err)
+
+    _, err = encoder(7, 0, time.Now().UnixNano(), []byte("hello"))
+    assert.Nil(t, err)
+
+    // flip a bit in the record data
+    data := buffer.Bytes()
+    data[LogRecordHeaderSize] ^= 1
+
+    decoder := NewLogRecordDecoder(1024, bytes.NewReader(data))
+    _, err = decoder()
+    corrupt, ok := err.(*common.CorruptRecordError)
+    assert.True(t, ok)
+    assert.Equal(t, uint64(7), corrupt.Index)
+    assert.NotEqual(t, corrupt.Expected, corrupt.Actual)
+
+    // a record at the wrong index is rejected
+    data[LogRecordHeaderSize] ^= 1
+    _, err = DecodeLogRecord(8, data)
+    assert.Equal(t, common.ErrRecordIndexMismatch, err)
+}
+
+func TestLogCursorCorruptRecord(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wallaby-v2")
+    assert.Nil(t, err)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.log")
+
+    log := openTestLog(t, dir)
+    for i := 0; i < 3; i++ {
+        _, err := log.Write([]byte("record"))
+        assert.Nil(t, err)
+    }
+    assert.Nil(t, log.Close())
+
+    // corrupt the data of the last record
+    file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+    assert.Nil(t, err)
+    _, err = file.WriteAt([]byte("X"), common.LogHeaderSize+3*(LogRecordHeaderSize+6)-1)
+    assert.Nil(t, err)
+    assert.Nil(t, file.Close())
+
+    log = openTestLog(t, dir)
+    defer log.Close()
+
+    cursor, err := log.Cursor()
+    assert.Nil(t, err)
+    for i := 0; i < 2; i++ {
+        record, err := cursor.Next()
+        assert.Nil(t, err)
+        assert.Equal(t, []byte("record"), record.Data())
+    }
+    _, err = cursor.Next()
+    _, ok := err.(*common.CorruptRecordError)
+    assert.True(t, ok)
+    assert.Nil(t, cursor.Close())
+
+    // recovery drops the corrupt record
+    report, err := log.Recover()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1), report.RecordsDropped)
+    assert.Equal(t, int64(LogRecordHeaderSize+6), report.BytesTruncated)
+}
+
+func TestIngestCorruptStream(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wallaby-v2")
+    assert.Nil(t, err)
+    defer os.RemoveAll(dir)
+    other, err := ioutil.TempDir("", "wallaby-v2")
+    assert.Nil(t, err)
+    defer os.RemoveAll(other)
+
+    source := openTestLog(t, dir)
+    defer source.Close()
+    for i := 0; i < 3; i++ {
+        _, err := source.Write([]byte("record"))
+        assert.Nil(t, err)
+    }
+
+    var buffer bytes.Buffer
+    assert.Nil(t, source.Pipe(0, 3, &buffer))
+    buffer.Bytes()[2*(LogRecordHeaderSize+6)+LogRecordHeaderSize] ^= 1
+
+    // records piped from another log keep their source index
+    target := openTestLog(t, other)
+    defer target.Close()
+    _, err = target.Write([]byte("first"))
+    assert.Nil(t, err)
+
+    count, err := target.Ingest(&buffer)
+    assert.Equal(t, uint64(2), count)
+    _, ok := err.(*common.CorruptRecordError)
+    assert.True(t, ok)
+
+    meta, err := target.Metadata()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(3), meta.Records)
+}
@@ -10,6 +10,7 @@ import (
 
     "github.com/blacklabeldata/wallaby/common"
     "github.com/blacklabeldata/wallaby/v1"
+    "github.com/blacklabeldata/wallaby/v2"
     "github.com/blacklabeldata/xbinary"
 )
 
@@ -29,15 +30,15 @@ func Create(filename string, config common.Config) (common.WriteAheadLog, error)
     // Determine if the given config is valid. If the given config is `nil`,
     // a `ErrConfigRequired` error will be returned.
     if &config == nil {
-        return nil, ErrConfigRequired
+        return nil, common.ErrConfigRequired
     }
 
     if config.TimeToLive < 0 {
-        return nil, ErrInvalidTTL
+        return nil, common.ErrInvalidTTL
     }
 
     if config.Strategy == nil {
-        return nil, ErrInvalidLogStrategy
+        return nil, common.ErrInvalidLogStrategy
     }
 
     // Open the file name, creating the file if it does not already exist. The
@@ -50,7 +51,8 @@ func Create(filename string, config common.Config) (common.WriteAheadLog, error)
         return nil, err
     }
 
-    // Truncate the log file if requested in the given config
+    // Truncate the log file if requested in the given config. The log
+    // version removes its index files when it is opened with the config.
     if config.Truncate {
         err = file.Truncate(0)
         if err != nil {
@@ -72,7 +74,7 @@ func Create(filename string, config common.Config) (common.WriteAheadLog, error)
 
     // If the file size suggests the header exists, open an existing file.
     // Otherwise create a new file based on the given config.
-    if stat.Size() >= LogHeaderSize {
+    if stat.Size() >= common.LogHeaderSize {
         return openExisting(file, filename, config)
     }
     return createNew(file, filename, config)
@@ -83,34 +85,30 @@ func Create(filename string, config common.Config) (common.WriteAheadLog, error)
 
 // ### **Creates a new log file**
 // A new log file is created with a file header consisting of a `LOG` signature
-// followed by an 8-bit version. The file header is then synced to disk and
-// a new log is created.
+// followed by an 8-bit version, the boolean flags and the TTL. The file header
+// is then synced to disk and a new log is created.
 
 // ###### Implentation
 func createNew(file *os.File, filename string, config common.Config) (common.WriteAheadLog, error) {
 
-    // Create a buffer for the 4-byte file header.
-    // The first 3 bytes contain the signature, `LOG`, followed by an 8-bit
-    // version.
-    buf := make([]byte, 8)
-
-    // Write the `LOG` file signature to the first 3 bytes of the file.
-    xbinary.LittleEndian.PutString(buf, 0, string(LogFileSignature))
-
-    // Set file version to the given `config.Version`.
-    buf[3] = byte(config.Version)
-
-    // Write the config flags into the buffer
-    xbinary.LittleEndian.PutUint32(buf, 4, config.Flags)
+    // Flags reserved by the log cannot be used as default record flags.
+    if config.Flags&common.ReservedFlags != 0 {
+        file.Close()
+        return nil, common.ErrReservedFlags
+    }
 
-    // Write the file header buffer to the file.
-    _, err := file.Write(buf)
+    // Write the 16-byte file header. The header starts with the `LOG` file
+    // signature followed by the given `config.Version` with the
+    // `ReservedFlagsFeature` bit, the config flags and the TTL for all the
+    // records in the file.
+    header := common.NewFileHeader(config.Version|common.ReservedFlagsFeature, config.Flags, config.TimeToLive)
+    _, err := common.WriteFileHeader(common.LogFileSignature, header, file)
 
     // If the header could not be written, close the file and return a
     // `ErrWriteLogHeader` error along with a `nil` log.
     if err != nil {
         file.Close()
-        return nil, ErrWriteLogHeader
+        return nil, common.ErrWriteLogHeader
     }
 
     // If writing the file header succeeded, sync the file header to disk.
@@ -119,7 +117,7 @@ func createNew(file *os.File, filename string, config common.Config) (common.Wri
     // If the sync command failed, return a `ErrWriteLogHeader` error and a
     // `nil` log.
     if err != nil {
-        return nil, ErrWriteLogHeader
+        return nil, common.ErrWriteLogHeader
     }
 
     // Returns the proper log parser based on the given `config.Version`.
@@ -151,21 +149,26 @@ func openExisting(file *os.File, filename string, config common.Config) (common.
     // If the header was read sucessfully, verify the file signature matches
     // the expected "LOG" signature. If the first 3 bytes do not match `LOG`,
     // return a `nil` log and a `ErrInvalidFileSignature`.
-    if !bytes.Equal(buf[0:3], LogFileSignature) {
-        return nil, ErrInvalidFileSignature
+    if !bytes.Equal(buf[0:3], common.LogFileSignature) {
+        return nil, common.ErrInvalidFileSignature
     }
 
     // Read the boolean flags from the file header and overwrite the config
-    // flags with the ones from the file.
+    // flags with the ones from the file. In files with the reserved record
+    // flags the `BaseIndexFlag` describes the file rather than its records
+    // and is not kept. Older files keep all their flags.
     flags, err := xbinary.LittleEndian.Uint32(buf, 4)
     if err != nil {
         return nil, err
     }
+    if buf[3]&common.ReservedFlagsFeature != 0 {
+        flags &^= common.BaseIndexFlag
+    }
     config.Flags = flags
 
     // The config version is updated to reflect the actual version of the file.
     // Then return the proper log parser based on the file version.
-    config.Version = uint8(buf[3])
+    config.Version = buf[3] &^ common.ReservedFlagsFeature
     return selectVersion(file, filename, config)
 }
 
@@ -177,11 +180,13 @@ func openExisting(file *os.File, filename string, config common.Config) (common.
 // Open the log file based on the current version of the file.
 // If the version is unrecognized, a `nil` log is returned as well as an
 // `ErrInvalidFileVersion` error.
-func selectVersion(file *os.File, filename string, config Config) (WriteAheadLog, error) {
+func selectVersion(file *os.File, filename string, config common.Config) (common.WriteAheadLog, error) {
     switch config.Version {
-    case VersionOne:
+    case v1.VersionOne:
         return v1.Create(file, filename, config)
+    case v2.VersionTwo:
+        return v2.Create(file, filename, config)
     default:
-        return nil, ErrInvalidFileVersion
+        return nil, common.ErrInvalidFileVersion
     }
 }
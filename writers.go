@@ -10,6 +10,8 @@ package wallaby
 import (
     "io"
     "os"
+
+    "github.com/blacklabeldata/wallaby/common"
 )
 
 // <br/>
@@ -50,7 +52,7 @@ type bufferedWriteCloser struct {
 // Write writes the data into the buffer.
 func (b bufferedWriteCloser) Write(data []byte) (n int, err error) {
     if len(data) > b.size {
-        return 0, ErrExceedsBufferSize
+        return 0, common.ErrExceedsBufferSize
     }
 
     if len(data)+b.offset > b.size {